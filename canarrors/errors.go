@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"sync"
 )
 
 var (
@@ -17,6 +18,14 @@ var (
 	Interrupted           = ErrorType{16, "Exited cleanly; interrupted by signal"}
 	Killed                = ErrorType{17, "Killed terraform; interrupted by signal"}
 	Timeout               = ErrorType{18, "Timeout expired"}
+	PlanMismatch          = ErrorType{19, "Saved plan does not match requested stack"}
+	NoHistory             = ErrorType{20, "No recorded history for stack"}
+	CheckFailed           = ErrorType{21, "Canary check failed"}
+	RunMismatch           = ErrorType{22, "Run ID already used for a different operation"}
+	StateChanged          = ErrorType{23, "State changed unexpectedly"}
+	Protected             = ErrorType{24, "Stack is protected"}
+	HasDependents         = ErrorType{25, "Stack is still used as an input by other stacks"}
+	TokenMismatch         = ErrorType{26, "Stacks to destroy no longer match confirmation token"}
 )
 
 type ErrorType struct {
@@ -53,11 +62,40 @@ func (err Error) Exit() {
 func ExitWith(err error) {
 	log.Println("Exited due to error:")
 	log.Println("\t" + err.Error())
-	exitCode := 1
+	RunExitHooks()
+	os.Exit(ExitCode(err))
+}
+
+var exitHooks []func()
+var exitHooksMutex sync.Mutex
+
+// Registers cleanup (e.g. removing temporary directories) to run before terracanary exits
+func AtExit(f func()) {
+	exitHooksMutex.Lock()
+	defer exitHooksMutex.Unlock()
+	exitHooks = append(exitHooks, f)
+}
+
+// Runs the registered exit hooks, most recently registered first; each hook only runs once
+func RunExitHooks() {
+	exitHooksMutex.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitHooksMutex.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// The exit code terracanary uses for an error; 0 for nil
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
 	if err, ok := err.(Error); ok {
-		exitCode = err.ExitCode
+		return err.ExitCode
 	}
-	os.Exit(exitCode)
+	return 1
 }
 
 func ExitIf(err error) {
@@ -1,10 +1,48 @@
 package cmd
 
 import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
 	"github.com/spf13/cobra"
+	"log"
+	"sort"
+	"time"
 )
 
+// True if the input stacks are the same (including aliases), regardless of order
+func sameInputs(a, b []stacks.Stack) bool {
+	strs := func(list []stacks.Stack) (ret []string) {
+		for _, s := range list {
+			ret = append(ret, s.InputString())
+		}
+		sort.Strings(ret)
+		return
+	}
+	as, bs := strs(a), strs(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Records the expiry of a stack applied with --ttl
+func setExpiry(stack stacks.Stack, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	log.Printf("Stack %s will expire in %s\n", stack, ttl)
+	return stack.SetExpiry(ttl)
+}
+
 func init() {
+	var plan string
+	var ttl time.Duration
+
 	var applyCmd = &cobra.Command{
 		Use: "apply" + singleStackUsage + passThroughUsage,
 		DisableFlagsInUseLine: true,
@@ -34,15 +72,47 @@ func init() {
 Note that two input variables are provided for each input stack -- a _stack_state variable that can be passed directly to terraform_remote_state as the config, and a _stack_version variable (for versioned stacks only), that's just the integer version number for that stack. The stack version inputs are mostly useful to provide as outputs to allow interrogating the deployed state.
 
 For versioned stacks, you may also supply an alias, which will be used as the prefix for the input variables instead of the stack name. This allows passing different versions of the same stack in with different names (e.g. "stable" and "testing" stack versions during a canary deployment).
+
+The input stacks and outcome of each apply are recorded alongside the state files; see "terracanary status".
+
+With --plan, applies exactly the plan previously saved by "terracanary plan --out" or "terracanary test --out", after checking that it was made for the selected stack and that the plan file hasn't changed since it was saved (its checksum is recorded with it). The input stacks and arguments recorded with the plan are used; any input stacks given must match them (in any order), and no additional terraform arguments are allowed.
+
+With --ttl, the stack is recorded as temporary (e.g. a preview version for a branch), expiring after the given duration; expired stacks are shown by "terracanary list --expired" and destroyed by "terracanary gc --expired". Applying again with --ttl extends the expiry; applying without it leaves the expiry as it was. The expiry is recorded even if the apply fails, so that partially built stacks get cleaned up too.
 `,
 		Example: `terracanary apply -S database
 terracanary apply -s code:$CODE_VERSION
-terracanary apply -s main:$MAIN_VERSION -I database -i code:$CODE_VERSION`,
+terracanary apply -s main:$MAIN_VERSION -I database -i code:$CODE_VERSION
+terracanary apply -s main:$MAIN_VERSION --plan main.plan
+terracanary apply -s main:$PREVIEW_VERSION -I database -i code:$PREVIEW_VERSION --ttl 72h`,
 		Run: func(cmd *cobra.Command, args []string) {
-			passThroughCommand(cmd, "apply", args)
+			stack := parseSingleStack(cmd)
+			inputStacks := parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
+			if plan == "" {
+				err := stack.Apply(inputStacks, args...)
+				exitIf(setExpiry(stack, ttl))
+				exitIf(err)
+				return
+			}
+
+			if len(args) > 0 {
+				exitWith(canarrors.PlanMismatch.Details("can't pass additional terraform arguments when applying a saved plan"))
+			}
+			if len(inputStacks) > 0 {
+				record, err := stacks.ReadPlanRecord(plan)
+				exitIf(err)
+				if !sameInputs(record.Inputs, inputStacks) {
+					exitWith(canarrors.PlanMismatch.Details("plan was made with input stacks ", record.Inputs, ", not ", inputStacks))
+				}
+			}
+			err := stack.ApplyPlan(plan)
+			exitIf(setExpiry(stack, ttl))
+			exitIf(err)
 		},
 	}
 
+	applyCmd.Flags().StringVar(&plan, "plan", "", "apply a plan saved by 'plan --out' or 'test --out'")
+	applyCmd.Flags().DurationVar(&ttl, "ttl", 0, "record that the stack is temporary, to be destroyed by 'gc --expired' after this long")
+
 	takesSingleStack(applyCmd)
 	takesInputStacks(applyCmd)
 	RootCmd.AddCommand(applyCmd)
@@ -0,0 +1,387 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Steps of a canary deployment, in order
+const (
+	canaryAllocated = "allocated" // New version number chosen
+	canaryBuilt     = "built"     // New version applied
+	canaryRouted    = "routed"    // Routing stack sending "next" traffic to the new version
+	canaryChecked   = "checked"   // Checks passed
+	canaryPromoted  = "promoted"  // Routing stack using the new version as both "current" and "next"
+)
+
+var canarySteps = []string{canaryAllocated, canaryBuilt, canaryRouted, canaryChecked, canaryPromoted}
+
+// Progress of a canary deployment, persisted so that it can be resumed or aborted. This record is the only record of
+// progress; a run ID's checkpoint only records that the canary finished, once the record has gone.
+type canaryRun struct {
+	Routing      stacks.Stack
+	New          stacks.Stack
+	Current      stacks.Stack
+	Inputs       []stacks.Stack
+	Args         []string
+	Checks       []string
+	CurrentAlias string
+	NextAlias    string
+	Step         string // Last completed step
+	RunID        string `json:",omitempty"`
+}
+
+func canaryRecord(routing stacks.Stack) string {
+	return "canaries/" + routing.String()
+}
+
+func (c *canaryRun) done(step string) bool {
+	completed, requested := -1, -1
+	for i, s := range canarySteps {
+		if s == c.Step {
+			completed = i
+		}
+		if s == step {
+			requested = i
+		}
+	}
+	return completed >= requested
+}
+
+func (c *canaryRun) complete(step string) error {
+	c.Step = step
+	log.Println("Canary step complete:", step)
+	return stacks.WriteRecord(canaryRecord(c.Routing), c)
+}
+
+// Run IDs let a rerun of "canary start" pick up the same canary, rather than starting another one
+func loadCanaryCheckpoint(runID string, routing stacks.Stack) (*stacks.Checkpoint, error) {
+	return stacks.LoadCheckpoint(runID, "canary "+routing.String())
+}
+
+func loadCanary(routing stacks.Stack) (*canaryRun, error) {
+	c := &canaryRun{}
+	found, err := stacks.ReadRecord(canaryRecord(routing), c)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, canarrors.NoHistory.Details("no canary in progress for ", routing)
+	}
+	return c, nil
+}
+
+func (c *canaryRun) runChecks() error {
+	for _, check := range c.Checks {
+		log.Println("Running canary check:", check)
+		cmd := exec.Command("sh", "-c", check)
+		// Keep stdout clean for data output
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"TERRACANARY_NEW_STACK="+c.New.String(),
+			"TERRACANARY_CURRENT_STACK="+c.Current.String(),
+		)
+		err := cmd.Run()
+		if err != nil {
+			return canarrors.CheckFailed.Details(check, ": ", err)
+		}
+	}
+	return nil
+}
+
+// Carries on from the last completed step; if checks fail, aborts the canary
+func (c *canaryRun) run() error {
+	var err error
+	if !c.done(canaryBuilt) {
+		log.Println("Building new stack:", c.New)
+		err = c.New.Apply(c.Inputs, c.Args...)
+		if err != nil {
+			return err
+		}
+		err = c.complete(canaryBuilt)
+		if err != nil {
+			return err
+		}
+	}
+	if !c.done(canaryRouted) {
+		err = promote(c.Routing, c.New, []string{c.NextAlias}, nil)
+		if err != nil {
+			return err
+		}
+		err = c.complete(canaryRouted)
+		if err != nil {
+			return err
+		}
+	}
+	if !c.done(canaryChecked) {
+		err = c.runChecks()
+		if canarrors.Is(err, canarrors.CheckFailed) {
+			log.Println("Canary failed; aborting:", err)
+			abortErr := c.abort()
+			if abortErr != nil {
+				return abortErr
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		err = c.complete(canaryChecked)
+		if err != nil {
+			return err
+		}
+	}
+	if !c.done(canaryPromoted) {
+		promoted, err := c.promoted()
+		if err != nil {
+			return err
+		}
+		if promoted {
+			// Interrupted after promoting, but before recording it
+			log.Println("Routing stack already promoted to:", c.New)
+		} else {
+			err = promote(c.Routing, c.New, []string{c.CurrentAlias, c.NextAlias}, nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = c.complete(canaryPromoted)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Canary succeeded; promoted:", c.New)
+	// Finish the run first, so that it can't be started again even if removing the canary record fails
+	cp, err := loadCanaryCheckpoint(c.RunID, c.Routing)
+	if err != nil {
+		return err
+	}
+	cp.Values["new"] = c.New.String()
+	err = cp.Finish()
+	if err != nil {
+		return err
+	}
+	return stacks.RemoveRecord(canaryRecord(c.Routing))
+}
+
+// True if the routing stack's last promotion, which finished applying, made the new stack current
+func (c *canaryRun) promoted() (bool, error) {
+	meta, err := c.Routing.Metadata()
+	if err != nil {
+		return false, err
+	}
+	n := len(meta.Promotions)
+	if n == 0 || meta.Promotions[n-1].Pending {
+		return false, nil
+	}
+	for _, to := range meta.Promotions[n-1].To {
+		if to.InputAlias == c.CurrentAlias && to.Subdir == c.New.Subdir && to.Version == c.New.Version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Sends traffic back to the current stack (if the routing stack references the new one) and destroys the new stack,
+// unless it's protected or still used by other stacks, as for "terracanary destroy". Refuses once the new stack has
+// been promoted, since it's then in use as the current stack.
+func (c *canaryRun) abort() error {
+	promoted, err := c.promoted()
+	if err != nil {
+		return err
+	}
+	if c.done(canaryPromoted) || promoted {
+		return fmt.Errorf("Canary of %s has already been promoted; resume it to finish, or use \"terracanary rollback\" "+
+			"to undo the promotion.", c.New)
+	}
+	meta, err := c.Routing.Metadata()
+	if err != nil {
+		return err
+	}
+	if meta.HasInput(c.New) {
+		var undo bool
+		if n := len(meta.Promotions); n > 0 {
+			for _, to := range meta.Promotions[n-1].To {
+				undo = undo || (to.Subdir == c.New.Subdir && to.Version == c.New.Version)
+			}
+		}
+		if undo {
+			_, err = c.Routing.Rollback()
+		} else {
+			err = promote(c.Routing, c.Current, []string{c.NextAlias}, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	exists, err := c.New.Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		// Only now that the routing stack no longer uses it
+		err = checkDestroyable([]stacks.Stack{c.New}, destroyOptions{}, s3Lookup())
+		if err != nil {
+			return err
+		}
+		err = destroyWithRetry(c.New, c.Inputs, c.Args, defaultRetry)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Canary aborted:", c.New)
+	// The run never finished, so rerunning with the same run ID starts afresh
+	return stacks.RemoveRecord(canaryRecord(c.Routing))
+}
+
+func init() {
+	var routingName, stackName string
+	var checks []string
+	var currentAlias, nextAlias string
+	var runID string
+
+	var canaryCmd = &cobra.Command{
+		Use:   "canary",
+		Short: "Run canary deployments of a versioned stack",
+		Long: `Performs a canary deployment: builds a new version of a versioned stack, re-applies the routing stack so that the new version is used as the "next" input (with the existing "current" input unchanged), runs the configured checks, and then either promotes the new version to both "current" and "next", or aborts by restoring the routing stack and destroying the new version.
+
+Progress is recorded alongside the state files, so that if a canary deployment is interrupted it can be continued with "canary resume" or abandoned with "canary abort" (unless the new version has already been promoted, in which case it can only be resumed, or undone with "terracanary rollback"). Only one canary deployment may be in progress per routing stack. If "canary start" is given a --run-id, rerunning it with the same run ID resumes that canary instead, or does nothing if it already succeeded (within the last ` + retentionDays() + ` days, after which the record of the run is pruned) (a canary that was aborted can be started again). The routing stack must already have been applied by terracanary with a "current" input.
+
+Checks are run with "sh -c", with TERRACANARY_NEW_STACK and TERRACANARY_CURRENT_STACK set in the environment. If any check fails, the canary is aborted and terracanary exits with code ` + canarrors.CheckFailed.ExitCodeString() + `.`,
+	}
+
+	var startCmd = &cobra.Command{
+		Use:                   "start --stack <stack> --routing <stack> [--check <command>...] [<flags>...]" + passThroughUsage,
+		DisableFlagsInUseLine: true,
+		Short:                 "Start a canary deployment",
+		Long:                  `Starts a canary deployment of a new version of the given stack (see "terracanary canary"). Input stacks and terraform arguments are used when applying (or destroying) the new version.`,
+		Example: `terracanary canary start --stack main --routing routing -I shared --check 'curl -f https://$(terracanary output -s $TERRACANARY_NEW_STACK hostname)/health'
+terracanary canary resume --routing routing
+terracanary canary abort --routing routing`,
+		Run: func(cmd *cobra.Command, args []string) {
+			routing := parseStackString(cmd, routingName)
+			stack := parseStackString(cmd, stackName)
+			if stack.Version != 0 {
+				cmd.Usage()
+				exitWith(canarrors.InvalidStack.Details("--stack takes a stack name without a version; the version is allocated by the canary."))
+			}
+			inputStacks := parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
+
+			cp, err := loadCanaryCheckpoint(runID, routing)
+			exitIf(err)
+			existing, err := loadCanary(routing)
+			if cp.Finished {
+				log.Printf("Run %s already finished (canary of %s); nothing to do.\n", runID, cp.Values["new"])
+				if err == nil && existing.RunID == runID {
+					// Interrupted after finishing, but before removing the canary record
+					exitIf(stacks.RemoveRecord(canaryRecord(routing)))
+				}
+				return
+			}
+			if err == nil {
+				if runID != "" && existing.RunID == runID {
+					log.Printf("Resuming canary of %s (run %s) after step '%s'\n", existing.New, runID, existing.Step)
+					exitIf(existing.run())
+					return
+				}
+				exitWith(fmt.Errorf("A canary is already in progress for %s; resume or abort it first.", routing))
+			} else if !canarrors.Is(err, canarrors.NoHistory) {
+				exitWith(err)
+			}
+
+			meta, err := routing.Metadata()
+			exitIf(err)
+			if meta.LastApply == nil {
+				exitWith(canarrors.NoHistory.Details("no recorded apply of ", routing))
+			}
+			var current *stacks.Stack
+			for i, input := range meta.LastApply.Inputs {
+				if input.InputAlias == currentAlias {
+					current = &meta.LastApply.Inputs[i]
+				}
+			}
+			if current == nil {
+				exitWith(canarrors.NoHistory.Details(routing, " has no '", currentAlias, "' input to canary against"))
+			}
+
+			next, err := stacks.Next("")
+			exitIf(err)
+			c := &canaryRun{
+				RunID:        runID,
+				Routing:      routing,
+				New:          stacks.New(stack.Subdir, next),
+				Current:      stacks.New(current.Subdir, current.Version),
+				Inputs:       inputStacks,
+				Args:         args,
+				Checks:       checks,
+				CurrentAlias: currentAlias,
+				NextAlias:    nextAlias,
+			}
+			log.Printf("Starting canary of %s against %s\n", c.New, c.Current)
+			exitIf(c.complete(canaryAllocated))
+			exitIf(c.run())
+		},
+	}
+	startCmd.Flags().StringVar(&stackName, "stack", "", "Versioned stack to deploy a new version of (required)")
+	startCmd.Flags().StringVar(&routingName, "routing", "", "Routing stack, as <stack> or <stack>:<version> (required)")
+	startCmd.Flags().StringArrayVar(&checks, "check", nil, "Shell command that must succeed before promoting; may repeat")
+	startCmd.Flags().StringVar(&currentAlias, "current-alias", "current", "Input alias of the routing stack for the current version")
+	startCmd.Flags().StringVar(&nextAlias, "next-alias", "next", "Input alias of the routing stack for the canary version")
+	startCmd.MarkFlagRequired("stack")
+	startCmd.MarkFlagRequired("routing")
+	takesInputStacks(startCmd)
+	takesRunID(startCmd, &runID)
+	canaryCmd.AddCommand(startCmd)
+
+	var resumeCmd = &cobra.Command{
+		Use:   "resume --routing <stack>",
+		Short: "Continue an interrupted canary deployment",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := loadCanary(parseStackString(cmd, routingName))
+			exitIf(err)
+			log.Printf("Resuming canary of %s after step '%s'\n", c.New, c.Step)
+			exitIf(c.run())
+		},
+	}
+
+	var abortCmd = &cobra.Command{
+		Use:   "abort --routing <stack>",
+		Short: "Abandon a canary deployment, destroying the new stack version",
+		Long:  `Abandons a canary deployment: re-applies the routing stack so that it no longer uses the new stack version, then destroys the new version. As with "terracanary destroy", the new version isn't destroyed if it's protected (exit code ` + canarrors.Protected.ExitCodeString() + `) or other stacks were last applied with it as an input (exit code ` + canarrors.HasDependents.ExitCodeString() + `); the canary then stays in progress, so that it can be aborted again once that's been dealt with.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := loadCanary(parseStackString(cmd, routingName))
+			exitIf(err)
+			exitIf(c.abort())
+		},
+	}
+
+	var statusCmd = &cobra.Command{
+		Use:   "status --routing <stack>",
+		Short: "Output the recorded progress of a canary deployment as JSON",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			c, err := loadCanary(parseStackString(cmd, routingName))
+			exitIf(err)
+			jsn, err := json.MarshalIndent(c, "", "    ")
+			exitIf(err)
+			fmt.Println(string(jsn))
+		},
+	}
+
+	for _, sub := range []*cobra.Command{resumeCmd, abortCmd, statusCmd} {
+		sub.Flags().StringVar(&routingName, "routing", "", "Routing stack, as <stack> or <stack>:<version> (required)")
+		sub.MarkFlagRequired("routing")
+		canaryCmd.AddCommand(sub)
+	}
+	RootCmd.AddCommand(canaryCmd)
+}
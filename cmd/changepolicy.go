@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/myhelix/terracanary/stacks"
+	"strings"
+)
+
+// Decides which planned changes are acceptable for "terracanary test"
+type changePolicy struct {
+	IgnoreUpdate []string // Address patterns whose in-place updates are allowed
+	AllowCreate  []string // Address patterns whose creation is allowed
+	IgnoreType   []string // Resource types whose changes (other than denied replacements) are all allowed
+	DenyReplace  []string // Address patterns whose replacement is never allowed, overriding everything else
+	AllowRead    bool     // Allow data sources to be read during apply
+	// Stop IgnoreUpdate patterns that don't name a module from also matching resources of that name inside any module
+	StrictIgnoreUpdate bool
+}
+
+type changeVerdict struct {
+	stacks.ResourceChange
+	Allowed bool
+	Reason  string
+}
+
+func (p changePolicy) evaluate(c stacks.ResourceChange) changeVerdict {
+	allow := func(reason string, args ...interface{}) changeVerdict {
+		return changeVerdict{c, true, fmt.Sprintf(reason, args...)}
+	}
+	deny := func(reason string, args ...interface{}) changeVerdict {
+		return changeVerdict{c, false, fmt.Sprintf(reason, args...)}
+	}
+
+	if c.Action == stacks.Replace {
+		if pattern := stacks.MatchingPattern(p.DenyReplace, c.Address); pattern != "" {
+			return deny("replacement denied by --deny-replace %s", pattern)
+		}
+	}
+	for _, t := range p.IgnoreType {
+		if c.Type == t {
+			return allow("type ignored by --ignore-type %s", t)
+		}
+	}
+	switch c.Action {
+	case stacks.Read:
+		if p.AllowRead {
+			return allow("data source read allowed by --allow-read")
+		}
+	case stacks.Update:
+		if pattern := stacks.MatchingPattern(p.IgnoreUpdate, c.Address); pattern != "" {
+			return allow("update ignored by --ignore-update %s", pattern)
+		}
+		if p.StrictIgnoreUpdate {
+			break
+		}
+		for _, pattern := range p.IgnoreUpdate {
+			if !strings.HasPrefix(pattern, "module.") && stacks.MatchAddress(pattern, stacks.WithoutModule(c.Address)) {
+				return allow("update ignored by --ignore-update %s (in any module)", pattern)
+			}
+		}
+	case stacks.Create:
+		if pattern := stacks.MatchingPattern(p.AllowCreate, c.Address); pattern != "" {
+			return allow("creation allowed by --allow-create %s", pattern)
+		}
+	}
+	return deny("not allowed")
+}
+
+// Evaluates every change, so that the full picture can be reported
+func (p changePolicy) evaluateAll(changes []stacks.ResourceChange) (verdicts []changeVerdict, denied int) {
+	for _, c := range changes {
+		v := p.evaluate(c)
+		if !v.Allowed {
+			denied++
+		}
+		verdicts = append(verdicts, v)
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/stacks"
+	"testing"
+)
+
+func TestChangePolicy(t *testing.T) {
+	lenient := changePolicy{
+		IgnoreUpdate: []string{"aws_ecs_service.default", "module.web.aws_instance.*"},
+		AllowCreate:  []string{"aws_cloudwatch_metric_alarm.*"},
+		IgnoreType:   []string{"aws_ecs_task_definition"},
+		DenyReplace:  []string{"aws_ecs_task_definition.keep"},
+		AllowRead:    true,
+	}
+	strict := lenient
+	strict.AllowRead = false
+	strict.StrictIgnoreUpdate = true
+
+	tests := []struct {
+		policy  changePolicy
+		address string
+		typ     string
+		action  stacks.ChangeAction
+		allowed bool
+	}{
+		{strict, "aws_ecs_service.default", "aws_ecs_service", stacks.Update, true},
+		{strict, "aws_ecs_service.default", "aws_ecs_service", stacks.Replace, false},
+		{strict, "module.web.aws_instance.a[0]", "aws_instance", stacks.Update, true},
+		{strict, "module.api.aws_instance.a", "aws_instance", stacks.Update, false},
+		{strict, "aws_instance.a", "aws_instance", stacks.Update, false},
+		{strict, "aws_cloudwatch_metric_alarm.cpu", "aws_cloudwatch_metric_alarm", stacks.Create, true},
+		{strict, "aws_cloudwatch_metric_alarm.cpu", "aws_cloudwatch_metric_alarm", stacks.Delete, false},
+		{strict, "aws_ecs_task_definition.app", "aws_ecs_task_definition", stacks.Replace, true},
+		{strict, "aws_ecs_task_definition.keep", "aws_ecs_task_definition", stacks.Replace, false},
+		{strict, "module.app.aws_ecs_service.default", "aws_ecs_service", stacks.Update, false},
+		{lenient, "module.app.aws_ecs_service.default", "aws_ecs_service", stacks.Update, true},
+		{lenient, "module.api.aws_instance.a", "aws_instance", stacks.Update, false},
+		{strict, "data.aws_ami.ubuntu", "aws_ami", stacks.Read, false},
+		{lenient, "data.aws_ami.ubuntu", "aws_ami", stacks.Read, true},
+	}
+	for _, tt := range tests {
+		v := tt.policy.evaluate(stacks.ResourceChange{Address: tt.address, Type: tt.typ, Action: tt.action})
+		if v.Allowed != tt.allowed {
+			t.Errorf("%s %s: allowed = %v (%s), want %v", tt.action, tt.address, v.Allowed, v.Reason, tt.allowed)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package cmd
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/myhelix/terracanary/canarrors"
 	"github.com/myhelix/terracanary/stacks"
@@ -9,7 +12,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -25,152 +29,528 @@ func requireConfirmation() {
 	}
 }
 
-func init() {
-	var destroyAll []string
-	var exceptV []string
-	var exceptU []string
-	var leave []string
-	var legacy, everything bool
-	var force string
-	var skipConfirmation bool
+// Selects and configures a set of stacks to destroy; used by the destroy command and pipelines
+type destroyOptions struct {
+	Stacks           []stacks.Stack // Explicitly requested stacks
+	All              []string       // Destroy all versions of these stacks
+	Except           []stacks.Stack
+	Legacy           bool
+	Everything       bool
+	Inputs           []stacks.Stack // May be useful for getting non-force destroy to run happily
+	Leave            []string       // Address patterns
+	LeaveReport      string         // JSON file to append resources removed by Leave to
+	Force            string         // Providers file to destroy with, overriding prevent_destroy, or forceAuto
+	SkipConfirmation bool
+	DryRun           bool
+	Parallelism      int // Stacks to destroy at once; 0 or 1 means one at a time, in-process
+	Retry            retryPolicy
+	Override         []stacks.Stack // Stacks to destroy even if protected
+	IgnoreDependents bool
+	PlanToken        bool   // Just output the token for the selected stacks
+	Confirm          string // Token the selected stacks must match, instead of interactive confirmation
+	RunID            string
+	Args             []string
+}
 
-	var destroyCmd = &cobra.Command{
-		Use: "destroy <flags>" + passThroughUsage,
-		DisableFlagsInUseLine: true,
-		Short: "Destroys one or more stacks",
-		Long: `Destroys stacks according to the specified flags. Returns success only if everything requested was actually destroyed (or didn't exist to begin with). For a normal destroy, you will need to provide whatever inputs are normally required by the stack via -i/-I.
+// Identifies the request for checkpoints: a hash of everything that selects the stacks or changes how they're
+// destroyed, so that a run ID can't be reused with a different request
+func (opts destroyOptions) operation() string {
+	strs := func(list []stacks.Stack) (ret []string) {
+		for _, s := range list {
+			ret = append(ret, s.String())
+		}
+		return
+	}
+	request := []interface{}{
+		strs(opts.Stacks), opts.All, strs(opts.Except), opts.Legacy, opts.Everything, strs(opts.Inputs),
+		opts.Leave, opts.Force, strs(opts.Override), opts.IgnoreDependents, opts.Args,
+	}
+	jsn, err := json.Marshal(request)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(jsn)
+	return "destroy " + hex.EncodeToString(sum[:])[:16]
+}
 
-To bypass terraform definition errors, you can use --force to supply an empty-except-providers definition file to use during destruction. USING THIS OPTION WILL BYPASS THE prevent_destroy DIRECTIVE.
+// Returns the stacks selected for destruction
+func (opts destroyOptions) resolve() ([]stacks.Stack, error) {
+	destroyStacks := append([]stacks.Stack{}, opts.Stacks...)
 
-Unless --skip-confirmation is specified, terracanary will prompt for interactive confirmation if the destroy command would remove all versions of any currently existing stack (this means it always prompts for destruction of non-versioned stacks).
+	for _, s := range opts.All {
+		all, err := stacks.All(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, stack := range all {
+			destroyStacks = append(destroyStacks, stack)
+		}
+	}
+	if opts.Legacy {
+		if opts.Force == "" {
+			return nil, fmt.Errorf("Must specify --force when destroying legacy stack.")
+		}
+		destroyStacks = append(destroyStacks, stacks.Legacy)
+	}
+	if opts.Everything {
+		all, err := stacks.All("")
+		if err != nil {
+			return nil, err
+		}
+		// Append here to allow future error behavior about destroying non-existent stacks
+		// to behave consistently, i.e. if I request all + foo, could return an error that
+		// foo doesn't exist.
+		destroyStacks = append(destroyStacks, all...)
+	}
 
-Because it's very common for the first attempt at destroying a complex stack to fail due to ordering issues, terracanary will automatically retry once if resources are left over after the first destroy. If a stack requested for destruction still has resources remaining after 2 attempts, terracanary will continue to process other stacks requested for destruction, but will exit with code ` + canarrors.IncompleteDestruction.ExitCodeString() + ` at the end. Unexpected failures will exit immediately with various other codes.`,
-		Example: `terracanary destroy -s main:4 -i code:5
-terracanary destroy -s code:5 -l module.task_definition.aws_ecs_task_definition.default
-terracanary destroy -a main -a code -e main:6 -e code:6
-terracanary destroy --legacy -l module.ecs_service.aws_route53_record.default
-terracanary destroy -s main:4 -f main/providers.tf
-terracanary destroy -A -f main/providers.tf --skip-confirmation`,
-		Run: func(cmd *cobra.Command, args []string) {
-			// May be useful for getting non-force destroy to run happily
-			inputStacks := parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
+	if len(opts.Except) > 0 {
+		log.Println("Requested stacks:", destroyStacks)
+		log.Println("Skipping stacks:", opts.Except)
+		destroyStacks = stacks.Subtract(destroyStacks, opts.Except)
+	}
+	return destroyStacks, nil
+}
 
-			destroyStacks := parseMultipleStacks(cmd)
-			skip := parseStackArgs(cmd, exceptU, exceptV)
+// Destroys the selected stacks. Stacks left incomplete don't stop the others being destroyed, but result in an
+// IncompleteDestruction error at the end; any other failure returns immediately.
+//
+// With a run ID, the selected stacks and each completed destroy are checkpointed; a rerun destroys the same selection,
+// skipping stacks already destroyed.
+func runDestroy(opts destroyOptions) error {
+	if opts.PlanToken {
+		destroyStacks, err := opts.resolve()
+		if err != nil {
+			return err
+		}
+		log.Println("Would destroy:", destroyStacks)
+		// Don't hand out a token for a destroy that would be refused anyway
+		err = checkDestroyable(destroyStacks, opts, s3Lookup())
+		if err != nil {
+			return err
+		}
+		fmt.Println(destroyToken(destroyStacks))
+		return nil
+	}
+	if opts.DryRun {
+		return runDestroyDryRun(opts)
+	}
+	cp, err := stacks.LoadCheckpoint(opts.RunID, opts.operation())
+	if err != nil {
+		return err
+	}
+	if cp.Finished {
+		log.Printf("Run %s already finished; nothing to do.\n", opts.RunID)
+		return nil
+	}
 
-			for _, s := range destroyAll {
-				all, err := stacks.All(s)
-				exitIf(err)
-				for _, stack := range all {
-					destroyStacks = append(destroyStacks, stack)
-				}
-			}
-			if legacy {
-				if force == "" {
-					canarrors.ExitWith(fmt.Errorf("Must specify --force when destroying legacy stack."))
+	var destroyStacks []stacks.Stack
+	if cp.Done(destroyResolved) {
+		for _, str := range strings.Fields(cp.Values[destroyResolved]) {
+			stack := stacks.Legacy
+			if str != stacks.Legacy.String() {
+				stack, err = stacks.ParseString(str)
+				if err != nil {
+					return err
 				}
-				destroyStacks = append(destroyStacks, stacks.Legacy)
-			}
-			if everything {
-				all, err := stacks.All("")
-				exitIf(err)
-				// Append here to allow future error behavior about destroying non-existent stacks
-				// to behave consistently, i.e. if I request all + foo, could return an error that
-				// foo doesn't exist.
-				destroyStacks = append(destroyStacks, all...)
 			}
+			destroyStacks = append(destroyStacks, stack)
+		}
+		log.Println("Will destroy (as previously selected):", destroyStacks)
+		err = checkToken(destroyStacks, opts.Confirm)
+		if err != nil {
+			return err
+		}
+		err = checkDestroyable(destroyStacks, opts, s3Lookup())
+		if err != nil {
+			return err
+		}
+	} else {
+		destroyStacks, err = opts.resolve()
+		if err != nil {
+			return err
+		}
+		log.Println("Will destroy:", destroyStacks)
+		err = checkToken(destroyStacks, opts.Confirm)
+		if err != nil {
+			return err
+		}
+		// Check before recording the selection, so that a refused destroy isn't resumed with it
+		err = checkDestroyable(destroyStacks, opts, s3Lookup())
+		if err != nil {
+			return err
+		}
+		err = confirmDestroy(destroyStacks, opts)
+		if err != nil {
+			return err
+		}
+		var strs []string
+		for _, stack := range destroyStacks {
+			strs = append(strs, stack.String())
+		}
+		err = cp.Complete(destroyResolved, map[string]string{destroyResolved: strings.Join(strs, " ")})
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Parallelism > 1 {
+		return runDestroyParallel(destroyStacks, opts, cp)
+	}
 
-			if len(skip) > 0 {
-				log.Println("Requested stacks:", destroyStacks)
-				log.Println("Skipping stacks:", skip)
-				destroyStacks = stacks.Subtract(destroyStacks, skip)
+	var anyFailure error
+	for _, stack := range destroyStacks {
+		if cp.Done(stack.String()) {
+			log.Println("Already destroyed in this run:", stack)
+			continue
+		}
+		err = destroyOne(stack, opts)
+		if err != nil && !canarrors.Is(err, canarrors.IncompleteDestruction) {
+			// Unexpected failure; stop immediately
+			return err
+		}
+		if err != nil {
+			// If destruction failed in an expected way, keep going (but fail eventually)
+			anyFailure = err
+			continue
+		}
+		err = cp.Complete(stack.String(), nil)
+		if err != nil {
+			return err
+		}
+	}
+	if anyFailure != nil {
+		return anyFailure
+	}
+	return cp.Finish()
+}
+
+// Logs what would be destroyed, without modifying anything (including checkpoints) or asking for confirmation
+func runDestroyDryRun(opts destroyOptions) error {
+	destroyStacks, err := opts.resolve()
+	if err != nil {
+		return err
+	}
+	log.Println("Would destroy:", destroyStacks)
+	err = checkDestroyable(destroyStacks, opts, s3Lookup())
+	if err != nil {
+		return err
+	}
+	existingStacks, err := stacks.All("")
+	if err != nil {
+		return err
+	}
+	log.Println("Stacks that would be left:", stacks.Subtract(existingStacks, destroyStacks))
+
+	for _, stack := range destroyStacks {
+		err = destroyDryRun(stack, opts)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Dry run; nothing was destroyed.")
+	return nil
+}
+
+// Where checkDestroyable gets existing stacks and their metadata
+type stackLookup struct {
+	all      func(subdir string) ([]stacks.Stack, error)
+	metadata func(stacks.Stack) (stacks.Metadata, error)
+}
+
+// Looks stacks up in S3
+func s3Lookup() stackLookup {
+	return stackLookup{all: stacks.All, metadata: stacks.Stack.Metadata}
+}
+
+// Fails if any of the stacks is protected (unless overridden), or still used by stacks that aren't being destroyed
+// (unless dependents are ignored)
+func checkDestroyable(destroyStacks []stacks.Stack, opts destroyOptions, lookup stackLookup) error {
+	err := checkProtection(destroyStacks, opts.Override, lookup.metadata)
+	if err != nil || opts.IgnoreDependents {
+		return err
+	}
+	return checkDependents(destroyStacks, lookup, "destroy them too, or use --ignore-dependents")
+}
+
+// Fails with a HasDependents error if any stack that isn't being destroyed (or moved) was last applied with one of the
+// stacks being destroyed as an input (e.g. a live main stack reading a code version's state through
+// terraform_remote_state), listing them, followed by advice on what to do instead
+func checkDependents(destroyStacks []stacks.Stack, lookup stackLookup, advice string) error {
+	all, err := lookup.all("")
+	if err != nil {
+		return err
+	}
+	var dependents []string
+	for _, other := range stacks.Subtract(all, destroyStacks) {
+		meta, err := lookup.metadata(other)
+		if err != nil {
+			return err
+		}
+		for _, s := range destroyStacks {
+			if meta.HasInput(s) {
+				dependents = append(dependents, fmt.Sprintf("%s (uses %s)", other, s))
 			}
+		}
+	}
+	if len(dependents) > 0 {
+		return canarrors.HasDependents.Details(strings.Join(dependents, ", "), "; ", advice)
+	}
+	return nil
+}
 
-			log.Println("Will destroy:", destroyStacks)
-
-			// During normal operations, you wouldn't typically remove ALL versions of a given stack;
-			// so check if that will be the case, and if so, ask for interactive confirmation.
-			existingStacks, err := stacks.All("")
-			exitIf(err)
-			leftStacks := stacks.Subtract(existingStacks, destroyStacks)
-			log.Println("Stacks that will be left:", leftStacks)
-			if !skipConfirmation {
-				willHave := make(map[string]bool)
-				for _, left := range leftStacks {
-					willHave[left.Subdir] = true
-				}
-				for _, had := range existingStacks {
-					if !willHave[had.Subdir] {
-						requireConfirmation()
-						break
-					}
-				}
+// A short hash identifying a set of stacks (in any order), for approving a destroy in advance
+func destroyToken(destroyStacks []stacks.Stack) string {
+	var strs []string
+	for _, s := range destroyStacks {
+		strs = append(strs, s.String())
+	}
+	sort.Strings(strs)
+	sum := sha256.Sum256([]byte(strings.Join(strs, "\n")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// Fails with a TokenMismatch error unless the stacks match the token (if one was given)
+func checkToken(destroyStacks []stacks.Stack, token string) error {
+	if token == "" {
+		return nil
+	}
+	if actual := destroyToken(destroyStacks); actual != token {
+		return canarrors.TokenMismatch.Details("expected ", token, ", but ", destroyStacks, " give ", actual)
+	}
+	log.Println("Stacks to destroy match confirmation token", token)
+	return nil
+}
+
+// Checkpoint step recording which stacks were selected
+const destroyResolved = "selected"
+
+// During normal operations, you wouldn't typically remove ALL versions of a given stack;
+// so check if that will be the case, and if so, ask for interactive confirmation.
+func confirmDestroy(destroyStacks []stacks.Stack, opts destroyOptions) error {
+	existingStacks, err := stacks.All("")
+	if err != nil {
+		return err
+	}
+	leftStacks := stacks.Subtract(existingStacks, destroyStacks)
+	log.Println("Stacks that will be left:", leftStacks)
+	if !opts.SkipConfirmation && opts.Confirm == "" {
+		willHave := make(map[string]bool)
+		for _, left := range leftStacks {
+			willHave[left.Subdir] = true
+		}
+		for _, had := range existingStacks {
+			if !willHave[had.Subdir] {
+				requireConfirmation()
+				break
 			}
+		}
+	}
+	return nil
+}
 
-			var anyFailure error
-			for _, stack := range destroyStacks {
-				exists, err := stack.Exists()
-				exitIf(err)
-				if !exists {
-					log.Println("Skipping nonexistent stack:", stack)
-					continue
-				}
+func destroyOne(stack stacks.Stack, opts destroyOptions) error {
+	exists, err := stack.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Println("Skipping nonexistent stack:", stack)
+		return nil
+	}
 
-				if force != "" {
-					log.Println("Attempting to force destruction using blank config.")
+	stack, cleanup, err := forceConfig(stack, opts.Force)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 
-					destroyPlayground, err := ioutil.TempDir("", "terracanary-destroy")
-					exitIf(err)
-					defer os.RemoveAll(destroyPlayground) // clean up
+	// Remove stuff from state that we don't want to destroy
+	removed, err := stack.RemoveFromState(opts.Leave)
+	if err != nil {
+		return err
+	}
+	if opts.LeaveReport != "" && len(removed) > 0 {
+		err = appendLeaveReport(opts.LeaveReport, stack, opts.Leave, removed)
+		if err != nil {
+			return err
+		}
+	}
 
-					// We need a basic config with provider definitions to accomplish our destruction
-					// If terraform doesn't have a provider, it will just ignore the resources in
-					// the state file, and think it actually did destroy everything despite doing
-					// nothing.
-					err = exec.Command("cp", force, destroyPlayground).Run()
-					exitIf(err)
+	return destroyWithRetry(stack, opts.Inputs, opts.Args, opts.Retry)
+}
 
-					stack.WorkingDirectory = destroyPlayground
-				}
+// With --force, runs terraform for the stack in a temporary directory containing only the given config file, or
+// with a bare --force, the stack's provider configuration (see providerConfig). The returned function cleans up
+// afterwards.
+func forceConfig(stack stacks.Stack, force string) (stacks.Stack, func(), error) {
+	if force == "" {
+		return stack, func() {}, nil
+	}
+	log.Println("Attempting to force destruction using blank config.")
 
-				// Remove stuff from state that we don't want to destroy
-				err = stack.RemoveFromState(leave)
-				exitIf(err)
+	// We need a basic config with provider definitions to accomplish our destruction
+	// If terraform doesn't have a provider, it will just ignore the resources in
+	// the state file, and think it actually did destroy everything despite doing
+	// nothing.
+	var config []byte
+	var err error
+	name := filepath.Base(force)
+	if force == forceAuto {
+		config, err = providerConfig(stack)
+		name = "providers.tf"
+	} else {
+		config, err = ioutil.ReadFile(force)
+	}
+	if err != nil {
+		return stack, nil, err
+	}
 
-				doDestroy := func() {
-					err = stack.Destroy(inputStacks, args...)
-					if err != nil && !canarrors.Is(err, canarrors.IncompleteDestruction) {
-						// Unexpected failure; exit immediately
-						exitWith(err)
-					}
-				}
-				doDestroy()
-				if err != nil {
-					log.Println("Retrying destroy of:", stack)
-					doDestroy()
-				}
-				if err != nil {
-					// If destruction failed in an expected way, keep going (but exit non-0 eventually)
-					// Unexpected errors were checked for above in doDestroy()
-					anyFailure = err
-				}
-			}
+	destroyPlayground, err := ioutil.TempDir("", "terracanary-destroy")
+	if err != nil {
+		return stack, nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(destroyPlayground)
+	}
+	err = ioutil.WriteFile(filepath.Join(destroyPlayground, name), config, 0644)
+	if err != nil {
+		cleanup()
+		return stack, nil, err
+	}
+
+	stack.WorkingDirectory = destroyPlayground
+	return stack, cleanup, nil
+}
+
+// The provider configuration archived when the stack was last applied, or failing that, extracted from its
+// subdirectory now
+func providerConfig(stack stacks.Stack) ([]byte, error) {
+	config, err := stack.ArchivedProviderConfig()
+	if err != nil || config != nil {
+		return config, err
+	}
+	if stack == stacks.Legacy {
+		return nil, fmt.Errorf("No provider configuration for legacy stack; use --force=<file>")
+	}
+	log.Printf("No provider configuration archived for %s; extracting it from %s\n", stack, stack.Subdir)
+	return stacks.ExtractProviderConfig(stack.Subdir)
+}
+
+// Plans destruction of the stack (without touching its state) and logs what would happen to each resource
+func destroyDryRun(stack stacks.Stack, opts destroyOptions) error {
+	exists, err := stack.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Println("Would skip nonexistent stack:", stack)
+		return nil
+	}
 
-			exitIf(anyFailure)
+	stack, cleanup, err := forceConfig(stack, opts.Force)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	changes, err := stack.PlannedChanges("", opts.Inputs, append([]string{"-destroy"}, opts.Args...)...)
+	if err != nil {
+		return err
+	}
+	// Resources matching --leave would be removed from state first, so terraform wouldn't destroy them
+	var destroyed, left []string
+	for _, c := range changes {
+		if stacks.MatchAnyAddress(opts.Leave, c.Address) {
+			left = append(left, c.Address)
+		} else if c.Action == stacks.Delete {
+			destroyed = append(destroyed, c.Address)
+		}
+	}
+
+	log.Printf("Would destroy %s: %d resources destroyed, %d left in place\n", stack, len(destroyed), len(left))
+	for _, addr := range destroyed {
+		log.Printf("\tdestroy  %s\n", addr)
+	}
+	for _, addr := range left {
+		log.Printf("\tleave    %s\n", addr)
+	}
+	return nil
+}
+
+func init() {
+	var opts destroyOptions
+	var exceptV []string
+	var exceptU []string
+	var overrides []string
+
+	var destroyCmd = &cobra.Command{
+		Use:                   "destroy <flags>" + passThroughUsage,
+		DisableFlagsInUseLine: true,
+		Short:                 "Destroys one or more stacks",
+		Long: `Destroys stacks according to the specified flags. Returns success only if everything requested was actually destroyed (or didn't exist to begin with). For a normal destroy, you will need to provide whatever inputs are normally required by the stack via -i/-I.
+
+To bypass terraform definition errors, you can use --force=<file> to supply an empty-except-providers definition file to use during destruction. Given without a file, --force instead uses the provider, terraform and variable blocks archived from the stack's configuration when it was last applied, or if there are none, extracts them from the stack's subdirectory; terraform arguments must then be given after "--". USING THIS OPTION WILL BYPASS THE prevent_destroy DIRECTIVE.
+
+Resources matching a --leave pattern are removed from the stack's state before it's destroyed, leaving them in place. Patterns are matched as by "terracanary test": '*' and '?' are wildcards, a module address matches everything in it, and a resource address matches all its instances. With --leave-report, the resources left in place (with the stack, type, ID and matching pattern of each) are added to a JSON file, as a record of cloud resources that terraform no longer manages.
+
+Stacks protected by "terracanary protect" aren't destroyed unless each is given with --override-protection; otherwise terracanary exits with code ` + canarrors.Protected.ExitCodeString() + ` before destroying anything.
+
+Stacks that aren't being destroyed, but were last applied (or last successfully applied) with one of the stacks being destroyed as an input (according to the records terracanary keeps of each apply), are listed, and terracanary exits with code ` + canarrors.HasDependents.ExitCodeString() + ` before destroying anything, unless --ignore-dependents is given.
+
+Unless --skip-confirmation is specified, terracanary will prompt for interactive confirmation if the destroy command would remove all versions of any currently existing stack (this means it always prompts for destruction of non-versioned stacks).
+
+Because it's very common for the first attempt at destroying a complex stack to fail due to ordering issues, terracanary will automatically retry if resources are left over after a destroy: once by default, or as many times as --retries says, waiting --retry-delay before the first retry and multiplying the wait by --retry-backoff each time after. The resources left over after each attempt are logged. With --retry-remaining, each retry targets only the resources left over, destroying them a type at a time, with networking resources (security groups, network interfaces, subnets, etc.), which AWS is often slow to release, last. If a stack requested for destruction still has resources remaining after the last retry, terracanary will continue to process other stacks requested for destruction, but will exit with code ` + canarrors.IncompleteDestruction.ExitCodeString() + ` at the end. Unexpected failures will exit immediately with various other codes.
+
+With --parallelism N, up to N stacks are destroyed at once, each by a separate terracanary process working in its own temporary copy of the project. A stack is only destroyed once any of the selected stacks that were last applied with it as an input have finished. Output from each stack is prefixed with its name, and a table of results is logged at the end. Exit codes are as above; after an unexpected failure, no more stacks are started, but those already being destroyed are allowed to finish.
+
+With --dry-run, nothing is changed and no confirmation is needed: the selected stacks are resolved, "terraform plan -destroy" is run for each one (with the given inputs, --force config and terraform arguments), and the resources that would be destroyed, and those that --leave would leave in place, are logged for each stack.
+
+For non-interactive approval, --plan-token outputs a token identifying the selected stacks, without destroying anything (after the protection and dependents checks above, so no token is output for a destroy that would be refused). Given that token with --confirm, a later destroy with the same flags goes ahead without asking for confirmation, but only if exactly the same stacks are still selected; otherwise terracanary exits with code ` + canarrors.TokenMismatch.ExitCodeString() + ` before destroying anything. For example, a CI pipeline can show the token and the stacks it covers for a human to approve, so that stacks created or changed in the meantime can't widen what is destroyed.
+
+With --run-id, the selected stacks and the progress of destroying them are recorded alongside the state files. Rerunning with the same run ID and the same stack selection, inputs, --leave, --force, --override-protection, --ignore-dependents and terraform arguments destroys the same stacks as were first selected (without asking for confirmation again), skipping those already destroyed; once everything has been destroyed, rerunning does nothing, until the record of the run is pruned ` + retentionDays() + ` days later. Reusing a run ID with different options exits with code ` + canarrors.RunMismatch.ExitCodeString() + `.`,
+		Example: `terracanary destroy -s main:4 -i code:5
+terracanary destroy -s code:5 -l module.task_definition.aws_ecs_task_definition.default
+terracanary destroy -a code -e code:6 -l 'module.task_definition' -l 'aws_ecr_repository.*' --leave-report orphaned.json
+terracanary destroy -a main -a code -e main:6 -e code:6
+terracanary destroy -a main -e main:6 -i code:6 --dry-run
+terracanary destroy -a main -a code -e main:6 -e code:6 --parallelism 4
+terracanary destroy -s main:4 -i code:5 --retries 4 --retry-delay 30s --retry-remaining
+terracanary destroy --legacy -l module.ecs_service.aws_route53_record.default
+terracanary destroy -s main:4 --force=main/providers.tf
+terracanary destroy -s main:4 --force
+terracanary destroy -A --force=main/providers.tf --skip-confirmation
+terracanary destroy -a main -e main:6 --plan-token
+terracanary destroy -a main -e main:6 --confirm 3f9a2c0d7e1b5a48`,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts.Inputs = parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
+			opts.Stacks = parseMultipleStacks(cmd)
+			opts.Except = parseStackArgs(cmd, exceptU, exceptV)
+			opts.Override = parseOverrides(cmd, overrides)
+			exitIf(checkForceArgs(cmd, opts, args))
+			opts.Args = args
+			exitIf(runDestroy(opts))
 		},
 	}
 
-	destroyCmd.Flags().StringArrayVarP(&destroyAll, "all", "a", []string{}, "destroy all versions of specified stack; may be repeated for multiple stacks")
-	destroyCmd.Flags().StringArrayVarP(&leave, "leave", "l", []string{}, "skip destruction of named resource by removing from state before destroy")
-	destroyCmd.Flags().StringVarP(&force, "force", "f", "", "override prevent_destroy and bypass terraform definition/input errors")
-	destroyCmd.Flags().BoolVarP(&everything, "everything", "A", false, "destroy ALL stacks")
-	destroyCmd.Flags().BoolVar(&legacy, "legacy", false, "destroy legacy stack (contents of base state filename)")
-	destroyCmd.Flags().BoolVar(&skipConfirmation, "skip-confirmation", false, "don't ask for interactive confirmation if command would leave no versions of an existing stack")
+	destroyCmd.Flags().StringArrayVarP(&opts.All, "all", "a", []string{}, "destroy all versions of specified stack; may be repeated for multiple stacks")
+	takesLeave(destroyCmd, &opts)
+	destroyCmd.Flags().BoolVarP(&opts.Everything, "everything", "A", false, "destroy ALL stacks")
+	destroyCmd.Flags().BoolVar(&opts.Legacy, "legacy", false, "destroy legacy stack (contents of base state filename)")
+	destroyCmd.Flags().IntVar(&opts.Parallelism, "parallelism", 1, "number of stacks to destroy at once")
+	destroyCmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "plan destruction of each stack and log what would be destroyed, without changing anything")
+	destroyCmd.Flags().BoolVar(&opts.SkipConfirmation, "skip-confirmation", false, "don't ask for interactive confirmation if command would leave no versions of an existing stack")
 	destroyCmd.Flags().StringArrayVarP(&exceptU, "except", "E", nil, "skip destroying specified unversioned stack; may repeat")
 	destroyCmd.Flags().StringArrayVarP(&exceptV, "except-version", "e", nil, "skip destroying specified stack version; may repeat")
 
+	takesForce(destroyCmd, &opts)
+	takesRetries(destroyCmd, &opts.Retry)
+	takesOverrideProtection(destroyCmd, &overrides)
+	destroyCmd.Flags().BoolVar(&opts.PlanToken, "plan-token", false, "output a token identifying the selected stacks for --confirm, without destroying anything")
+	destroyCmd.Flags().StringVar(&opts.Confirm, "confirm", "", "token from --plan-token that the selected stacks must still match; replaces interactive confirmation")
+	destroyCmd.Flags().BoolVar(&opts.IgnoreDependents, "ignore-dependents", false, "destroy stacks even if other stacks were last applied with them as inputs")
 	takesMultipleStacks(destroyCmd)
 	takesInputStacks(destroyCmd)
+	takesRunID(destroyCmd, &opts.RunID)
 
 	RootCmd.AddCommand(destroyCmd)
 }
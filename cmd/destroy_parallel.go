@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Results of destroying a stack as part of a parallel destroy
+const (
+	destroyDestroyed  = "destroyed"
+	destroyIncomplete = "INCOMPLETE"
+	destroyFailed     = "FAILED"
+	destroySkipped    = "skipped; doesn't exist"
+	destroyEarlier    = "destroyed earlier in this run"
+	destroyNotStarted = "not started"
+)
+
+type destroyResult struct {
+	Stack    stacks.Stack
+	Result   string
+	ExitCode int
+	Duration time.Duration
+}
+
+// Copies output to stderr a line at a time, prefixed with the stack it came from, so that the output of concurrent
+// destroys can be told apart
+type prefixWriter struct {
+	prefix string
+	mutex  *sync.Mutex // Shared by all writers
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Writes out any final partial line
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	os.Stderr.Write(append([]byte(w.prefix), line...))
+}
+
+// Arguments for a terracanary subprocess that destroys just the given stack, writing any --leave report to
+// leaveReport
+func destroyChildArgs(stack stacks.Stack, opts destroyOptions, leaveReport string) ([]string, error) {
+	// The parent handles confirmation, dependents and checkpoints; make sure a run ID from the environment isn't
+	// picked up
+	args := []string{"destroy", "--skip-confirmation", "--ignore-dependents", "--run-id="}
+	switch {
+	case stack == stacks.Legacy:
+		args = append(args, "--legacy")
+	case stack.Version == 0:
+		args = append(args, "-S", stack.String())
+	default:
+		args = append(args, "-s", stack.String())
+	}
+	if overridden(stack, opts.Override) {
+		args = append(args, "--override-protection", stack.String())
+	}
+	for _, input := range opts.Inputs {
+		args = append(args, inputStackArgs(input)...)
+	}
+	for _, l := range opts.Leave {
+		args = append(args, "-l", l)
+	}
+	if opts.LeaveReport != "" {
+		args = append(args, "--leave-report="+leaveReport)
+	}
+	switch opts.Force {
+	case "":
+	case forceAuto:
+		args = append(args, "--force")
+	default:
+		// The subprocess runs elsewhere
+		force, err := filepath.Abs(opts.Force)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--force="+force)
+	}
+	args = append(args, opts.Retry.args()...)
+	return append(append(args, "--"), opts.Args...), nil
+}
+
+// Flag and value giving an input stack the way parseStackArgs reads it back; an unversioned stack with an alias is
+// given as '<stack>::<alias>', since -I takes no alias
+func inputStackArgs(input stacks.Stack) []string {
+	switch {
+	case input.InputAlias != "":
+		var version string
+		if input.Version != 0 {
+			version = strconv.FormatUint(uint64(input.Version), 10)
+		}
+		return []string{"-i", input.Subdir + ":" + version + ":" + input.InputAlias}
+	case input.Version == 0:
+		return []string{"-I", input.String()}
+	default:
+		return []string{"-i", input.String()}
+	}
+}
+
+// Destroys the stack in a terracanary subprocess, running in its own copy of the project so that it doesn't share
+// terraform's working state with other destroys
+func destroyChild(executable string, stack stacks.Stack, opts destroyOptions, outputMutex *sync.Mutex) *destroyResult {
+	start := time.Now()
+	result := &destroyResult{Stack: stack}
+	fail := func(err error) *destroyResult {
+		log.Printf("Error destroying %s: %s\n", stack, err)
+		result.Result = destroyFailed
+		result.ExitCode = canarrors.ExitCode(err)
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	exists, err := stack.Exists()
+	if err != nil {
+		return fail(err)
+	}
+	if !exists {
+		result.Result = destroySkipped
+		return result
+	}
+
+	root, cleanup, err := stacks.Overlay(stack.Subdir)
+	if err != nil {
+		return fail(err)
+	}
+	defer cleanup()
+	// Each subprocess has its own report, merged into the real one afterwards so that they can't clash
+	leaveReport := filepath.Join(root, ".terracanary-leave-report.json")
+	args, err := destroyChildArgs(stack, opts, leaveReport)
+	if err != nil {
+		return fail(err)
+	}
+
+	output := &prefixWriter{prefix: "[" + stack.String() + "] ", mutex: outputMutex}
+	cmd := exec.Command(executable, args...)
+	cmd.Dir = root
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = stacks.RunProcess(cmd)
+	output.Flush()
+	if opts.LeaveReport != "" {
+		if reportErr := mergeLeaveReport(leaveReport, opts.LeaveReport, outputMutex); reportErr != nil && err == nil {
+			return fail(reportErr)
+		}
+	}
+
+	result.Duration = time.Since(start)
+	result.ExitCode = exitStatus(err)
+	switch {
+	case err == nil:
+		result.Result = destroyDestroyed
+	case result.ExitCode == canarrors.IncompleteDestruction.ExitCode:
+		result.Result = destroyIncomplete
+	default:
+		result.Result = destroyFailed
+	}
+	return result
+}
+
+// Adds the entries from a subprocess's --leave report (if it wrote one) to the main report
+func mergeLeaveReport(from, to string, mutex *sync.Mutex) error {
+	entries, err := readLeaveReport(from)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return appendLeaveEntries(to, entries)
+}
+
+// Destroys up to opts.Parallelism stacks at once. A stack isn't destroyed until any selected stacks that were last
+// applied with it as an input have finished. Exit semantics are the same as for sequential destroys: stacks left
+// incomplete result in an IncompleteDestruction error once everything else is done, while any other failure stops
+// further destroys from starting (those already running are waited for) and is returned.
+func runDestroyParallel(destroyStacks []stacks.Stack, opts destroyOptions, cp *stacks.Checkpoint) error {
+	waitFor := make(map[stacks.Stack][]stacks.Stack)
+	for _, s := range destroyStacks {
+		meta, err := s.Metadata()
+		if err != nil {
+			return err
+		}
+		for _, input := range destroyStacks {
+			if input != s && meta.HasInput(input) {
+				waitFor[input] = append(waitFor[input], s)
+			}
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	results := make(map[stacks.Stack]*destroyResult)
+	var pending []stacks.Stack
+	for _, s := range destroyStacks {
+		if cp.Done(s.String()) {
+			results[s] = &destroyResult{Stack: s, Result: destroyEarlier}
+		} else {
+			pending = append(pending, s)
+		}
+	}
+	ready := func(s stacks.Stack) bool {
+		for _, user := range waitFor[s] {
+			if results[user] == nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	var outputMutex sync.Mutex
+	finished := make(chan *destroyResult)
+	start := func(s stacks.Stack) {
+		log.Println("Starting destroy of:", s)
+		go func() {
+			finished <- destroyChild(executable, s, opts, &outputMutex)
+		}()
+	}
+
+	running := 0
+	var anyFailure, unexpected error
+	for {
+		if unexpected == nil {
+			var notReady []stacks.Stack
+			for _, s := range pending {
+				if running < opts.Parallelism && ready(s) {
+					start(s)
+					running++
+				} else {
+					notReady = append(notReady, s)
+				}
+			}
+			pending = notReady
+			if running == 0 && len(pending) > 0 {
+				// Stacks using each other; order doesn't matter
+				start(pending[0])
+				running++
+				pending = pending[1:]
+			}
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-finished
+		running--
+		results[r.Stack] = r
+		log.Printf("Finished destroy of %s: %s\n", r.Stack, r.Result)
+		switch r.Result {
+		case destroyDestroyed, destroySkipped:
+			err = cp.Complete(r.Stack.String(), nil)
+			if err != nil && unexpected == nil {
+				unexpected = err
+			}
+		case destroyIncomplete:
+			anyFailure = canarrors.IncompleteDestruction.Details(r.Stack)
+		default:
+			if unexpected == nil {
+				unexpected = canarrors.ErrorType{ExitCode: r.ExitCode, Description: "Failed to destroy stack"}.Details(r.Stack)
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STACK\tRESULT\tEXIT CODE\tDURATION")
+	for _, s := range destroyStacks {
+		r := results[s]
+		if r == nil {
+			r = &destroyResult{Stack: s, Result: destroyNotStarted}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", s, r.Result, r.ExitCode, r.Duration.Round(time.Second))
+	}
+	w.Flush()
+
+	if unexpected != nil {
+		return unexpected
+	}
+	if anyFailure != nil {
+		return anyFailure
+	}
+	return cp.Finish()
+}
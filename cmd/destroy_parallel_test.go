@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/stacks"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// The arguments for a child destroy must select the same stacks when the child parses them
+func TestDestroyChildArgsRoundTrip(t *testing.T) {
+	stack := stacks.New("main", 7)
+	inputs := []stacks.Stack{
+		stacks.New("shared", 0),
+		stacks.New("code", 5),
+		{Subdir: "routing", InputAlias: "current"},
+		{Subdir: "code", Version: 6, InputAlias: "next"},
+	}
+	opts := destroyOptions{Inputs: inputs, Args: []string{"-var", "x=1"}}
+	args, err := destroyChildArgs(stack, opts, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, _, err := RootCmd.Find(args[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.ParseFlags(args[1:]); err != nil {
+		t.Fatalf("parsing %q: %s", args, err)
+	}
+	if got := parseMultipleStacks(cmd); !reflect.DeepEqual(got, []stacks.Stack{stack}) {
+		t.Errorf("stacks = %v, want %v", got, []stacks.Stack{stack})
+	}
+	// Unversioned inputs come back first
+	got := parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
+	sort.Slice(got, func(i, j int) bool { return got[i].InputString() < got[j].InputString() })
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].InputString() < inputs[j].InputString() })
+	if !reflect.DeepEqual(got, inputs) {
+		t.Errorf("inputs = %v, want %v (args %q)", got, inputs, args)
+	}
+	if !reflect.DeepEqual(cmd.Flags().Args(), opts.Args) {
+		t.Errorf("pass-through args = %q, want %q", cmd.Flags().Args(), opts.Args)
+	}
+}
+
+func TestInputStackArgs(t *testing.T) {
+	tests := []struct {
+		input stacks.Stack
+		want  []string
+	}{
+		{stacks.New("shared", 0), []string{"-I", "shared"}},
+		{stacks.New("code", 5), []string{"-i", "code:5"}},
+		{stacks.Stack{Subdir: "routing", InputAlias: "current"}, []string{"-i", "routing::current"}},
+		{stacks.Stack{Subdir: "code", Version: 6, InputAlias: "next"}, []string{"-i", "code:6:next"}},
+	}
+	for _, tt := range tests {
+		if got := inputStackArgs(tt.input); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("inputStackArgs(%v) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
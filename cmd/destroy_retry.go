@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How to retry destroys that leave resources behind
+type retryPolicy struct {
+	Retries   int           // Attempts after the first
+	Delay     time.Duration // Before the first retry
+	Backoff   float64       // Multiplies the delay after each retry
+	Remaining bool          // Target retries at the remaining resources, in order of type (see destroyOrder)
+}
+
+var defaultRetry = retryPolicy{Retries: 1, Backoff: 2}
+
+func takesRetries(cmd *cobra.Command, retry *retryPolicy) {
+	cmd.Flags().IntVar(&retry.Retries, "retries", defaultRetry.Retries, "number of times to retry destroying a stack that has resources left over")
+	cmd.Flags().DurationVar(&retry.Delay, "retry-delay", defaultRetry.Delay, "time to wait before the first retry")
+	cmd.Flags().Float64Var(&retry.Backoff, "retry-backoff", defaultRetry.Backoff, "factor to increase --retry-delay by after each retry")
+	cmd.Flags().BoolVar(&retry.Remaining, "retry-remaining", false, "target retries at the resources left over, a type at a time, leaving networking resources until last")
+}
+
+// Arguments for a terracanary subprocess to retry in the same way
+func (r retryPolicy) args() []string {
+	args := []string{
+		"--retries=" + strconv.Itoa(r.Retries),
+		"--retry-delay=" + r.Delay.String(),
+		"--retry-backoff=" + strconv.FormatFloat(r.Backoff, 'g', -1, 64),
+	}
+	if r.Remaining {
+		args = append(args, "--retry-remaining")
+	}
+	return args
+}
+
+// Resource types that other resources commonly can't be destroyed before (often because AWS takes a while to
+// release network interfaces), in the order to destroy them: last of all, after every other type.
+var destroyLast = []string{
+	"aws_lb_target_group",
+	"aws_alb_target_group",
+	"aws_lambda_function",
+	"aws_network_interface",
+	"aws_eip",
+	"aws_nat_gateway",
+	"aws_security_group_rule",
+	"aws_security_group",
+	"aws_route",
+	"aws_route_table_association",
+	"aws_route_table",
+	"aws_subnet",
+	"aws_internet_gateway",
+	"aws_vpc",
+}
+
+// Groups resource addresses by type, in the order to destroy them: types not in destroyLast first (alphabetically),
+// then those in destroyLast
+func destroyOrder(addresses []string) [][]string {
+	rank := make(map[string]int)
+	for i, t := range destroyLast {
+		rank[t] = i + 1
+	}
+	byType := make(map[string][]string)
+	var types []string
+	for _, a := range addresses {
+		t := resourceType(a)
+		if byType[t] == nil {
+			types = append(types, t)
+		}
+		byType[t] = append(byType[t], a)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if rank[types[i]] != rank[types[j]] {
+			return rank[types[i]] < rank[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	var groups [][]string
+	for _, t := range types {
+		groups = append(groups, byType[t])
+	}
+	return groups
+}
+
+// The resource type in an address like "module.foo.aws_instance.bar[0]"
+func resourceType(address string) string {
+	parts := strings.Split(address, ".")
+	i := 0
+	for i+1 < len(parts) && parts[i] == "module" {
+		i += 2
+	}
+	if i < len(parts) && parts[i] == "data" {
+		i++
+	}
+	if i < len(parts) {
+		return parts[i]
+	}
+	return address
+}
+
+// Destroys the stack, retrying as configured if resources are left over, and logging what remains after each
+// attempt. Returns IncompleteDestruction if resources still remain after the last retry.
+func destroyWithRetry(stack stacks.Stack, inputStacks []stacks.Stack, args []string, retry retryPolicy) error {
+	err := stack.Destroy(inputStacks, args...)
+	delay := retry.Delay
+	for attempt := 1; canarrors.Is(err, canarrors.IncompleteDestruction); attempt++ {
+		remaining, listErr := stack.StateList()
+		if listErr != nil {
+			return listErr
+		}
+		log.Printf("Attempt %d of %d to destroy %s left %d resource(s): %s\n",
+			attempt, retry.Retries+1, stack, len(remaining), strings.Join(remaining, ", "))
+		if attempt > retry.Retries {
+			break
+		}
+
+		if delay > 0 {
+			log.Printf("Waiting %s before retrying...\n", delay)
+			time.Sleep(delay)
+			delay = time.Duration(float64(delay) * retry.Backoff)
+		}
+		log.Println("Retrying destroy of:", stack)
+		if retry.Remaining {
+			err = destroyRemaining(stack, inputStacks, args, remaining)
+		} else {
+			err = stack.Destroy(inputStacks, args...)
+		}
+	}
+	return err
+}
+
+// Destroys the given resources a type at a time, in destroyOrder
+func destroyRemaining(stack stacks.Stack, inputStacks []stacks.Stack, args []string, remaining []string) (err error) {
+	for _, group := range destroyOrder(remaining) {
+		targetArgs := append([]string{}, args...)
+		for _, address := range group {
+			targetArgs = append(targetArgs, "-target="+address)
+		}
+		log.Printf("Destroying %d %s resource(s) in %s\n", len(group), resourceType(group[0]), stack)
+		err = stack.Destroy(inputStacks, targetArgs...)
+		if err == nil {
+			// Nothing left at all
+			return nil
+		}
+		if !canarrors.Is(err, canarrors.IncompleteDestruction) {
+			return err
+		}
+	}
+	return err
+}
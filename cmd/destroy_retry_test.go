@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResourceType(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"aws_instance.web", "aws_instance"},
+		{"aws_instance.web[0]", "aws_instance"},
+		{"data.aws_ami.ubuntu", "aws_ami"},
+		{"module.net.aws_subnet.private[1]", "aws_subnet"},
+		{"module.a.module.b.data.aws_iam_policy_document.p", "aws_iam_policy_document"},
+		{"module.data.aws_vpc.main", "aws_vpc"},
+		{"weird", "weird"},
+	}
+	for _, tt := range tests {
+		if got := resourceType(tt.address); got != tt.want {
+			t.Errorf("resourceType(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestDestroyOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		want      [][]string
+	}{
+		{
+			name: "networking last, in destroyLast order",
+			addresses: []string{
+				"aws_vpc.main",
+				"aws_security_group.web",
+				"aws_instance.web[0]",
+				"aws_subnet.a",
+				"aws_instance.web[1]",
+				"aws_ecs_service.app",
+				"aws_subnet.b",
+			},
+			want: [][]string{
+				{"aws_ecs_service.app"},
+				{"aws_instance.web[0]", "aws_instance.web[1]"},
+				{"aws_security_group.web"},
+				{"aws_subnet.a", "aws_subnet.b"},
+				{"aws_vpc.main"},
+			},
+		},
+		{
+			name:      "module resources grouped by type",
+			addresses: []string{"module.x.aws_eip.ip", "aws_eip.other", "module.x.aws_s3_bucket.b"},
+			want:      [][]string{{"module.x.aws_s3_bucket.b"}, {"module.x.aws_eip.ip", "aws_eip.other"}},
+		},
+		{
+			name: "nothing",
+		},
+	}
+	for _, tt := range tests {
+		if got := destroyOrder(tt.addresses); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: destroyOrder = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyArgs(t *testing.T) {
+	tests := []struct {
+		policy retryPolicy
+		want   []string
+	}{
+		{defaultRetry, []string{"--retries=1", "--retry-delay=0s", "--retry-backoff=2"}},
+		{
+			retryPolicy{Retries: 3, Delay: 90 * time.Second, Backoff: 1.5, Remaining: true},
+			[]string{"--retries=3", "--retry-delay=1m30s", "--retry-backoff=1.5", "--retry-remaining"},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.args(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v.args() = %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"strings"
+	"testing"
+)
+
+func TestDestroyToken(t *testing.T) {
+	main3 := stacks.New("main", 3)
+	main4 := stacks.New("main", 4)
+	shared := stacks.New("shared", 0)
+
+	tests := []struct {
+		name string
+		a, b []stacks.Stack
+		same bool
+	}{
+		{"same stacks", []stacks.Stack{main3, shared}, []stacks.Stack{main3, shared}, true},
+		{"order doesn't matter", []stacks.Stack{main3, shared}, []stacks.Stack{shared, main3}, true},
+		{"aliases don't matter", []stacks.Stack{main3}, []stacks.Stack{{Subdir: "main", Version: 3, InputAlias: "next"}}, true},
+		{"different version", []stacks.Stack{main3}, []stacks.Stack{main4}, false},
+		{"extra stack", []stacks.Stack{main3}, []stacks.Stack{main3, main4}, false},
+		{"versioned and unversioned", []stacks.Stack{stacks.New("main", 0)}, []stacks.Stack{main3}, false},
+		{"legacy", []stacks.Stack{stacks.Legacy}, nil, false},
+	}
+	for _, tt := range tests {
+		a, b := destroyToken(tt.a), destroyToken(tt.b)
+		if len(a) != 16 {
+			t.Errorf("%s: token %q isn't 16 characters", tt.name, a)
+		}
+		if (a == b) != tt.same {
+			t.Errorf("%s: destroyToken(%v) = %s, destroyToken(%v) = %s; want same = %v", tt.name, tt.a, a, tt.b, b, tt.same)
+		}
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	selected := []stacks.Stack{stacks.New("main", 3), stacks.New("code", 5)}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"no token", "", true},
+		{"matching token", destroyToken(selected), true},
+		{"token for other stacks", destroyToken(selected[:1]), false},
+		{"garbage", "not-a-token", false},
+	}
+	for _, tt := range tests {
+		err := checkToken(selected, tt.token)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error %s", tt.name, err)
+		}
+		if !tt.ok && !canarrors.Is(err, canarrors.TokenMismatch) {
+			t.Errorf("%s: got %v, want a TokenMismatch error", tt.name, err)
+		}
+	}
+}
+
+// A lookup finding the given stacks and metadata instead of reading S3
+func fakeLookup(all []stacks.Stack, metadata map[stacks.Stack]stacks.Metadata) stackLookup {
+	return stackLookup{
+		all: func(string) ([]stacks.Stack, error) {
+			return all, nil
+		},
+		metadata: func(s stacks.Stack) (stacks.Metadata, error) {
+			return metadata[s], nil
+		},
+	}
+}
+
+func TestCheckDependents(t *testing.T) {
+	main1, main2 := stacks.New("main", 1), stacks.New("main", 2)
+	code1, code2 := stacks.New("code", 1), stacks.New("code", 2)
+	routing := stacks.New("routing", 0)
+	usingInputs := func(inputs ...stacks.Stack) stacks.Metadata {
+		return stacks.Metadata{LastApply: &stacks.ApplyRecord{Success: true, Inputs: inputs}}
+	}
+	lookup := fakeLookup([]stacks.Stack{main1, main2, code1, code2, routing}, map[stacks.Stack]stacks.Metadata{
+		routing: usingInputs(stacks.Stack{Subdir: "main", Version: 2, InputAlias: "current"}),
+		main1:   usingInputs(code1),
+		main2:   usingInputs(code2),
+	})
+
+	tests := []struct {
+		name       string
+		destroy    []stacks.Stack
+		ignore     bool
+		dependents []string // Expected in the error; none means destroying is allowed
+	}{
+		{"unused", []stacks.Stack{routing}, false, nil},
+		{"used by a remaining stack", []stacks.Stack{code2}, false, []string{"main:2 (uses code:2)"}},
+		{"used through an alias", []stacks.Stack{main2}, false, []string{"routing (uses main:2)"}},
+		{"dependent also being destroyed", []stacks.Stack{main1, code1}, false, nil},
+		{"dependent destroyed, other dependents remain", []stacks.Stack{main2, code2}, false, []string{"routing (uses main:2)"}},
+		{"several", []stacks.Stack{code1, code2}, false, []string{"main:1 (uses code:1)", "main:2 (uses code:2)"}},
+		{"ignored", []stacks.Stack{code1, code2}, true, nil},
+	}
+	for _, tt := range tests {
+		err := checkDestroyable(tt.destroy, destroyOptions{IgnoreDependents: tt.ignore}, lookup)
+		if len(tt.dependents) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", tt.name, err)
+			}
+			continue
+		}
+		if !canarrors.Is(err, canarrors.HasDependents) {
+			t.Errorf("%s: got %v, want a HasDependents error", tt.name, err)
+			continue
+		}
+		for _, d := range tt.dependents {
+			if !strings.Contains(err.Error(), d) {
+				t.Errorf("%s: error %q doesn't mention %s", tt.name, err, d)
+			}
+		}
+	}
+}
+
+func TestForceFlag(t *testing.T) {
+	tests := []struct {
+		args      []string
+		wantForce string
+		wantErr   bool
+	}{
+		{[]string{}, "", false},
+		{[]string{"--force"}, forceAuto, false},
+		{[]string{"--force", "--", "-var", "x=1"}, forceAuto, false},
+		{[]string{"--force=auto"}, "auto", false},
+		{[]string{"--force=providers.tf", "--", "-var", "x=1"}, "providers.tf", false},
+		{[]string{"-f=providers.tf"}, "providers.tf", false},
+		// Not taken as the file
+		{[]string{"--force", "providers.tf"}, forceAuto, true},
+		{[]string{"-f", "providers.tf", "--", "-var", "x=1"}, forceAuto, true},
+	}
+	for _, tt := range tests {
+		var opts destroyOptions
+		cmd := &cobra.Command{}
+		takesForce(cmd, &opts)
+		if err := cmd.ParseFlags(tt.args); err != nil {
+			t.Fatalf("parsing %q: %s", tt.args, err)
+		}
+		err := checkForceArgs(cmd, opts, cmd.Flags().Args())
+		if opts.Force != tt.wantForce || (err != nil) != tt.wantErr {
+			t.Errorf("%q: force = %q, error = %v; want %q, error %v", tt.args, opts.Force, err, tt.wantForce, tt.wantErr)
+		}
+	}
+}
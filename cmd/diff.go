@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// Attribute names that get masked in diff output for v3 states, which don't record which attributes are sensitive
+var sensitiveAttribute = regexp.MustCompile(`(?i)(password|secret|private_key|token|credential)`)
+
+const masked = "(sensitive)"
+
+func maskedAttribute(value string, present, sensitive bool) string {
+	switch {
+	case !present:
+		return "(none)"
+	case sensitive:
+		return masked
+	default:
+		return fmt.Sprintf("%q", value)
+	}
+}
+
+// Lists changed attributes, masking the values of those for which sensitive returns true
+func attributeChanges(from, to map[string]string, sensitive func(key string) bool) (changes []string) {
+	keys := make(map[string]bool)
+	for k := range from {
+		keys[k] = true
+	}
+	for k := range to {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		a, inFrom := from[k]
+		b, inTo := to[k]
+		if inFrom == inTo && a == b {
+			continue
+		}
+		hide := sensitive(k)
+		changes = append(changes, fmt.Sprintf("%s: %s => %s", k, maskedAttribute(a, inFrom, hide), maskedAttribute(b, inTo, hide)))
+	}
+	return
+}
+
+func printOutputChanges(from, to map[string]stacks.OutputValue) {
+	names := make(map[string]bool)
+	for n := range from {
+		names[n] = true
+	}
+	for n := range to {
+		names[n] = true
+	}
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	show := func(o stacks.OutputValue, present bool) string {
+		switch {
+		case !present:
+			return "(none)"
+		case o.Sensitive:
+			return masked
+		default:
+			return fmt.Sprintf("%#v", o.Value)
+		}
+	}
+	for _, n := range sorted {
+		a, inFrom := from[n]
+		b, inTo := to[n]
+		if inFrom == inTo && reflect.DeepEqual(a, b) {
+			continue
+		}
+		fmt.Printf("~ output.%s: %s => %s\n", n, show(a, inFrom), show(b, inTo))
+	}
+}
+
+func init() {
+	var diffCmd = &cobra.Command{
+		Use:   "diff <stack>[:<version>] <stack>[:<version>]",
+		Short: "Compare the state of two stacks",
+		Long: `Compares the current state of two stacks (typically two versions of the same stack), and outputs the resources that exist only in the first ("-") or second ("+") stack, and attribute changes for resources with the same address in both ("~"). Changed root module outputs are listed as well.
+
+Values of outputs and attributes marked sensitive are masked. States written before terraform 0.12 don't record which attributes are sensitive, so for those, attributes whose names look like they contain secrets (passwords, tokens, keys, etc.) are masked instead.`,
+		Example: `terracanary diff main:11 main:12`,
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			from := parseStackString(cmd, args[0])
+			to := parseStackString(cmd, args[1])
+			for _, s := range []stacks.Stack{from, to} {
+				exists, err := s.Exists()
+				exitIf(err)
+				if !exists {
+					exitWith(canarrors.NoSuchStack.Details(s))
+				}
+			}
+
+			fromState, err := from.State()
+			exitIf(err)
+			toState, err := to.State()
+			exitIf(err)
+
+			for _, r := range fromState.Resources {
+				if toState.Resource(r.Address) == nil {
+					fmt.Printf("- %s (%s)\n", r.Address, r.ID)
+				}
+			}
+			for _, r := range toState.Resources {
+				if fromState.Resource(r.Address) == nil {
+					fmt.Printf("+ %s (%s)\n", r.Address, r.ID)
+				}
+			}
+			for _, r := range fromState.Resources {
+				other := toState.Resource(r.Address)
+				if other == nil {
+					continue
+				}
+				// The name heuristic is only a fallback for v3 states
+				legacy := fromState.Version < 4 || toState.Version < 4
+				sensitive := func(key string) bool {
+					return (legacy && sensitiveAttribute.MatchString(key)) || r.SensitiveAttribute(key) || other.SensitiveAttribute(key)
+				}
+				changes := attributeChanges(r.Attributes, other.Attributes, sensitive)
+				if len(changes) == 0 {
+					continue
+				}
+				fmt.Printf("~ %s\n", r.Address)
+				for _, c := range changes {
+					fmt.Printf("    %s\n", c)
+				}
+			}
+			printOutputChanges(fromState.Outputs, toState.Outputs)
+		},
+	}
+
+	RootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,371 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/config"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Decides which old versions of versioned stacks "terracanary gc" destroys
+type gcPolicy struct {
+	Keep   int           // Newest versions to keep per stack
+	MinAge time.Duration // Versions younger than this are kept
+	Stacks []string      // Only collect versions of these stacks; all versioned stacks if empty
+	// Only collect stacks applied with a TTL that has passed, instead of applying Keep and MinAge; these may be
+	// unversioned stacks too
+	Expired  bool
+	Override []stacks.Stack // Collect these even if they're protected
+}
+
+type gcDecision struct {
+	Stack  stacks.Stack
+	Delete bool
+	Reason string
+}
+
+// Everything gc needs to know about existing stacks
+type gcInventory struct {
+	all      []stacks.Stack
+	subdirs  map[string]bool
+	metadata map[stacks.Stack]stacks.Metadata
+	pointers map[stacks.Stack][]string // Stack => pointer outputs referring to it
+	scanned  map[stacks.Stack]bool     // Stacks whose pointer outputs have been read
+	state    func(stacks.Stack) (*stacks.State, error)
+}
+
+func (inv *gcInventory) created(s stacks.Stack) (time.Time, error) {
+	created := inv.metadata[s].Created
+	if created.IsZero() {
+		return s.LastModified()
+	}
+	return created, nil
+}
+
+// Stacks recorded as using the given stack: as an input to their last apply, or as what their last promotion
+// replaced (i.e. what "terracanary rollback" would restore)
+func (inv *gcInventory) referrers(s stacks.Stack) (refs []stacks.Stack) {
+	for _, other := range inv.all {
+		meta := inv.metadata[other]
+		used := meta.HasInput(s)
+		if n := len(meta.Promotions); n > 0 {
+			for _, from := range meta.Promotions[n-1].From {
+				used = used || (from.Subdir == s.Subdir && from.Version == s.Version)
+			}
+		}
+		if used {
+			refs = append(refs, other)
+		}
+	}
+	return
+}
+
+// Reads the outputs of the given stack that point at stack versions (e.g. main_stack_version), as routing stacks
+// commonly provide. An output named after a stack points at that stack's version; one named after an input alias
+// (e.g. current_stack_version) could be any stack, so it protects that version of every stack.
+func (inv *gcInventory) scanPointers(s stacks.Stack) error {
+	if inv.scanned[s] || s == stacks.Legacy {
+		return nil
+	}
+	inv.scanned[s] = true
+	st, err := inv.state(s)
+	if err != nil {
+		return err
+	}
+	for name, out := range st.Outputs {
+		if !strings.HasSuffix(name, config.Global.StateVersionPostfix) {
+			continue
+		}
+		prefix := strings.TrimSuffix(name, config.Global.StateVersionPostfix)
+		version, err := strconv.ParseUint(fmt.Sprint(out.Value), 10, 32)
+		if err != nil || version == 0 {
+			continue
+		}
+		for _, target := range inv.all {
+			if target.Version == uint(version) && (target.Subdir == prefix || !inv.subdirs[prefix]) {
+				inv.pointers[target] = append(inv.pointers[target], s.String()+"."+name)
+			}
+		}
+	}
+	return nil
+}
+
+func gcInventoryOf(all []stacks.Stack) (*gcInventory, error) {
+	inv := &gcInventory{
+		all:      all,
+		subdirs:  make(map[string]bool),
+		metadata: make(map[stacks.Stack]stacks.Metadata),
+		pointers: make(map[stacks.Stack][]string),
+		scanned:  make(map[stacks.Stack]bool),
+		state:    stacks.Stack.State,
+	}
+	var err error
+	for _, s := range all {
+		inv.subdirs[s.Subdir] = true
+		inv.metadata[s], err = s.Metadata()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+// Decides the fate of every version of the selected versioned stacks. Deletions come first, ordered so that stacks
+// are destroyed before the stacks they used as inputs.
+func (policy gcPolicy) decide() ([]gcDecision, *gcInventory, error) {
+	all, err := stacks.All("")
+	if err != nil {
+		return nil, nil, err
+	}
+	inv, err := gcInventoryOf(all)
+	if err != nil {
+		return nil, nil, err
+	}
+	decisions, err := policy.decideFor(inv)
+	return decisions, inv, err
+}
+
+func (policy gcPolicy) decideFor(inv *gcInventory) ([]gcDecision, error) {
+	all := inv.all
+
+	selected := make(map[string]bool)
+	for _, s := range policy.Stacks {
+		selected[s] = true
+	}
+	bySubdir := make(map[string][]stacks.Stack)
+	for _, s := range all {
+		if len(selected) > 0 && !selected[s.Subdir] {
+			continue
+		}
+		if (policy.Expired && inv.metadata[s].Expires != nil) || (!policy.Expired && s.Version != 0) {
+			bySubdir[s.Subdir] = append(bySubdir[s.Subdir], s)
+		}
+	}
+
+	var subdirs []string
+	for subdir := range bySubdir {
+		subdirs = append(subdirs, subdir)
+	}
+	sort.Strings(subdirs)
+
+	reasons := make(map[stacks.Stack]string) // Stacks being kept, and why
+	var candidates []stacks.Stack
+	for _, subdir := range subdirs {
+		versions := bySubdir[subdir]
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Version > versions[j].Version
+		})
+		for i, s := range versions {
+			created, err := inv.created(s)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case inv.metadata[s].Protected != nil && !overridden(s, policy.Override):
+				reasons[s] = "protected"
+			case policy.Expired && !inv.metadata[s].Expired():
+				reasons[s] = fmt.Sprintf("expires in %s", formatAge(time.Until(*inv.metadata[s].Expires)))
+			case policy.Expired:
+				candidates = append(candidates, s)
+			case i < policy.Keep:
+				reasons[s] = fmt.Sprintf("one of newest %d", policy.Keep)
+			case time.Since(created) < policy.MinAge:
+				reasons[s] = fmt.Sprintf("younger than %s", policy.MinAge)
+			default:
+				candidates = append(candidates, s)
+			}
+		}
+	}
+	deleting := func(s stacks.Stack) bool {
+		_, keep := reasons[s]
+		return !keep && inSlice(s, candidates)
+	}
+
+	// Keep anything used by a stack that is being kept; keeping a stack may in turn mean keeping its inputs, so
+	// repeat until nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for _, s := range all {
+			if !deleting(s) {
+				err := inv.scanPointers(s)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, c := range candidates {
+			if !deleting(c) {
+				continue
+			}
+			if ptrs := inv.pointers[c]; len(ptrs) > 0 {
+				reasons[c] = "pointed to by " + strings.Join(ptrs, ", ")
+				changed = true
+				continue
+			}
+			for _, ref := range inv.referrers(c) {
+				if !deleting(ref) {
+					reasons[c] = "used by " + ref.String()
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	var deletions, kept []gcDecision
+	remaining := make(map[stacks.Stack]bool)
+	for _, c := range candidates {
+		if deleting(c) {
+			remaining[c] = true
+		}
+	}
+	for len(remaining) > 0 {
+		progress := false
+		for _, c := range candidates {
+			if !remaining[c] {
+				continue
+			}
+			usedByRemaining := false
+			for _, ref := range inv.referrers(c) {
+				usedByRemaining = usedByRemaining || (remaining[ref] && ref != c)
+			}
+			if !usedByRemaining {
+				deletions = append(deletions, gcDecision{Stack: c, Delete: true, Reason: policy.deleteReason()})
+				delete(remaining, c)
+				progress = true
+			}
+		}
+		if !progress {
+			// Stacks using each other; order doesn't matter
+			for _, c := range candidates {
+				if remaining[c] {
+					deletions = append(deletions, gcDecision{Stack: c, Delete: true, Reason: policy.deleteReason()})
+					delete(remaining, c)
+				}
+			}
+		}
+	}
+	for _, s := range all {
+		if reason, ok := reasons[s]; ok {
+			kept = append(kept, gcDecision{Stack: s, Reason: reason})
+		}
+	}
+	return append(deletions, kept...), nil
+}
+
+func (p gcPolicy) deleteReason() string {
+	if p.Expired {
+		return "expired and unused"
+	}
+	return "old and unused"
+}
+
+func inSlice(s stacks.Stack, list []stacks.Stack) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Destroys the stacks the policy selects, using the inputs and arguments each was last applied with. As with
+// destroy, stacks left incomplete don't stop the rest being collected, but result in an IncompleteDestruction error.
+func runGC(policy gcPolicy, opts destroyOptions, dryRun bool) error {
+	if policy.Keep < 1 && !policy.Expired {
+		return fmt.Errorf("Must keep at least 1 version of each stack.")
+	}
+	decisions, inv, err := policy.decide()
+	if err != nil {
+		return err
+	}
+
+	var deletions []gcDecision
+	for _, d := range decisions {
+		verdict := "keep"
+		if d.Delete {
+			verdict = "DELETE"
+			deletions = append(deletions, d)
+		}
+		log.Printf("\t%-6s  %-12s  %s\n", verdict, d.Stack, d.Reason)
+	}
+	if len(deletions) == 0 {
+		log.Println("Nothing to collect.")
+		return nil
+	}
+	if dryRun {
+		log.Println("Dry run; not destroying anything.")
+		return nil
+	}
+
+	var anyFailure error
+	for _, d := range deletions {
+		stackOpts := opts
+		if last := inv.metadata[d.Stack].LastApply; last != nil {
+			stackOpts.Inputs = last.Inputs
+			if len(opts.Args) == 0 {
+				stackOpts.Args = last.Args
+			}
+		}
+		log.Printf("Collecting %s (inputs: %s)\n", d.Stack, inputStrings(stackOpts.Inputs))
+		err = destroyOne(d.Stack, stackOpts)
+		if err != nil && !canarrors.Is(err, canarrors.IncompleteDestruction) {
+			return err
+		}
+		if err != nil {
+			anyFailure = err
+		}
+	}
+	return anyFailure
+}
+
+func init() {
+	var policy gcPolicy
+	var opts destroyOptions
+	var dryRun bool
+	var overrides []string
+
+	var gcCmd = &cobra.Command{
+		Use:                   "gc [--keep <num>] [--min-age <duration>] [--expired] [--stack <stack>...] [--dry-run] [<flags>...]" + passThroughUsage,
+		DisableFlagsInUseLine: true,
+		Short:                 "Destroy old, unused versions of versioned stacks",
+		Long: `Destroys old versions of versioned stacks, such as those abandoned by failed deployments. For each versioned stack (or just those given with --stack), the newest --keep versions are always kept, and so is any version created less than --min-age ago. Unversioned stacks are never collected.
+
+Versions still in use are also kept, even if they are old, as are versions protected by "terracanary protect" (unless given with --override-protection) and anything they use:
+
+* Versions pointed to by an output named <stack>_stack_version (e.g. main_stack_version in a routing stack) of any stack that is being kept. An output named after an input alias instead (e.g. current_stack_version) keeps that version of every stack.
+* Versions recorded as inputs of the last apply of a stack that is being kept, or as inputs that "terracanary rollback" would restore.
+
+Each version is destroyed as "terracanary destroy" would, retrying if resources are left over (see --retries), using the input stacks (and, unless arguments are given, the terraform arguments) it was last applied with. Stacks are destroyed before the stacks they used as inputs. --leave, --leave-report and --force work as for destroy.
+
+With --expired, only stacks applied with "terracanary apply --ttl" whose TTL has passed are collected (including unversioned ones), regardless of --keep and --min-age; they are still kept if in use.
+
+The decision for every version, and the reason for it, is logged; with --dry-run, nothing is destroyed.`,
+		Example: `terracanary gc --dry-run
+terracanary gc --expired
+terracanary gc --keep 2 --min-age 72h --stack main --stack code -l module.task_definition.aws_ecs_task_definition.default`,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitIf(checkForceArgs(cmd, opts, args))
+			opts.Args = args
+			policy.Override = parseOverrides(cmd, overrides)
+			opts.Override = policy.Override
+			exitIf(runGC(policy, opts, dryRun))
+		},
+	}
+	gcCmd.Flags().IntVar(&policy.Keep, "keep", 3, "number of newest versions of each stack to keep")
+	gcCmd.Flags().DurationVar(&policy.MinAge, "min-age", 24*time.Hour, "only collect versions older than this")
+	gcCmd.Flags().StringArrayVar(&policy.Stacks, "stack", nil, "only collect versions of this stack; may repeat")
+	gcCmd.Flags().BoolVar(&policy.Expired, "expired", false, "only collect stacks whose TTL (from 'apply --ttl') has expired, ignoring --keep and --min-age")
+	gcCmd.Flags().BoolVar(&dryRun, "dry-run", false, "log what would be collected, without destroying anything")
+	takesLeave(gcCmd, &opts)
+	takesForce(gcCmd, &opts)
+	takesRetries(gcCmd, &opts.Retry)
+	takesOverrideProtection(gcCmd, &overrides)
+	RootCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/config"
+	"github.com/myhelix/terracanary/stacks"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An inventory of the given stacks, in order, without reading anything from S3
+func testInventory(metadata map[stacks.Stack]stacks.Metadata, outputs map[stacks.Stack]map[string]stacks.OutputValue,
+	all ...stacks.Stack) *gcInventory {
+	inv := &gcInventory{
+		all:      all,
+		subdirs:  make(map[string]bool),
+		metadata: make(map[stacks.Stack]stacks.Metadata),
+		pointers: make(map[stacks.Stack][]string),
+		scanned:  make(map[stacks.Stack]bool),
+		state: func(s stacks.Stack) (*stacks.State, error) {
+			return &stacks.State{Outputs: outputs[s]}, nil
+		},
+	}
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for _, s := range all {
+		inv.subdirs[s.Subdir] = true
+		meta := metadata[s]
+		if meta.Created.IsZero() {
+			meta.Created = old
+		}
+		inv.metadata[s] = meta
+	}
+	return inv
+}
+
+func TestGCDecisions(t *testing.T) {
+	if config.Global == nil {
+		config.Global = &config.Config{StateVersionPostfix: "_stack_version"}
+	}
+	main1, main2, main3 := stacks.New("main", 1), stacks.New("main", 2), stacks.New("main", 3)
+	code1, code2 := stacks.New("code", 1), stacks.New("code", 2)
+	routing := stacks.New("routing", 0)
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	usingInputs := func(inputs ...stacks.Stack) stacks.Metadata {
+		return stacks.Metadata{LastApply: &stacks.ApplyRecord{Success: true, Inputs: inputs}}
+	}
+	pointer := func(v interface{}) stacks.OutputValue {
+		return stacks.OutputValue{Value: v}
+	}
+
+	tests := []struct {
+		name     string
+		policy   gcPolicy
+		all      []stacks.Stack
+		metadata map[stacks.Stack]stacks.Metadata
+		outputs  map[stacks.Stack]map[string]stacks.OutputValue
+		want     []gcDecision // Reasons are matched as prefixes
+	}{
+		{
+			name:   "newest versions kept",
+			policy: gcPolicy{Keep: 2},
+			all:    []stacks.Stack{main1, main2, main3, routing},
+			want: []gcDecision{
+				{main1, true, "old and unused"},
+				{main2, false, "one of newest 2"},
+				{main3, false, "one of newest 2"},
+			},
+		},
+		{
+			name:     "young versions kept",
+			policy:   gcPolicy{Keep: 1, MinAge: 24 * time.Hour},
+			all:      []stacks.Stack{main1, main2, main3},
+			metadata: map[stacks.Stack]stacks.Metadata{main2: {Created: time.Now()}},
+			want: []gcDecision{
+				{main1, true, "old and unused"},
+				{main2, false, "younger than 24h"},
+				{main3, false, "one of newest 1"},
+			},
+		},
+		{
+			name:   "only selected stacks",
+			policy: gcPolicy{Keep: 1, Stacks: []string{"code"}},
+			all:    []stacks.Stack{main1, main2, code1, code2},
+			want:   []gcDecision{{code1, true, "old and unused"}, {code2, false, "one of newest 1"}},
+		},
+		{
+			name:   "protected",
+			policy: gcPolicy{},
+			all:    []stacks.Stack{main1, main2},
+			metadata: map[stacks.Stack]stacks.Metadata{
+				main1: {Protected: &stacks.Protection{}},
+				main2: {Protected: &stacks.Protection{}},
+			},
+			want: []gcDecision{{main1, false, "protected"}, {main2, false, "protected"}},
+		},
+		{
+			name:   "protection overridden",
+			policy: gcPolicy{Override: []stacks.Stack{main1}},
+			all:    []stacks.Stack{main1, main2},
+			metadata: map[stacks.Stack]stacks.Metadata{
+				main1: {Protected: &stacks.Protection{}},
+				main2: {Protected: &stacks.Protection{}},
+			},
+			want: []gcDecision{{main1, true, "old and unused"}, {main2, false, "protected"}},
+		},
+		{
+			name:     "inputs of kept stacks kept",
+			policy:   gcPolicy{Keep: 1},
+			all:      []stacks.Stack{main1, main2, code1, code2},
+			metadata: map[stacks.Stack]stacks.Metadata{main2: usingInputs(code1)},
+			want: []gcDecision{
+				{main1, true, "old and unused"},
+				{main2, false, "one of newest 1"},
+				{code1, false, "used by main:2"},
+				{code2, false, "one of newest 1"},
+			},
+		},
+		{
+			name:   "inputs kept transitively",
+			policy: gcPolicy{Keep: 0},
+			all:    []stacks.Stack{main1, code1, routing},
+			metadata: map[stacks.Stack]stacks.Metadata{
+				routing: usingInputs(main1),
+				main1:   usingInputs(code1),
+			},
+			want: []gcDecision{{main1, false, "used by routing"}, {code1, false, "used by main:1"}},
+		},
+		{
+			name:     "replaced by last promotion kept",
+			policy:   gcPolicy{Keep: 0},
+			all:      []stacks.Stack{main1, main2, routing},
+			metadata: map[stacks.Stack]stacks.Metadata{routing: {Promotions: []stacks.Promotion{{From: []stacks.Stack{main1}}}}},
+			want:     []gcDecision{{main2, true, "old and unused"}, {main1, false, "used by routing"}},
+		},
+		{
+			name:   "pointer outputs",
+			policy: gcPolicy{Keep: 0},
+			all:    []stacks.Stack{main1, main2, main3, code1, code2, routing},
+			outputs: map[stacks.Stack]map[string]stacks.OutputValue{routing: {
+				"main_stack_version":    pointer("2"),
+				"current_stack_version": pointer(float64(1)),
+				"other":                 pointer("3"),
+			}},
+			want: []gcDecision{
+				{code2, true, "old and unused"},
+				{main3, true, "old and unused"},
+				{main1, false, "pointed to by routing.current_stack_version"},
+				{main2, false, "pointed to by routing.main_stack_version"},
+				{code1, false, "pointed to by routing.current_stack_version"},
+			},
+		},
+		{
+			name:   "users destroyed before their inputs",
+			policy: gcPolicy{Keep: 0},
+			all:    []stacks.Stack{code1, main1, main2},
+			metadata: map[stacks.Stack]stacks.Metadata{
+				main2: usingInputs(main1, code1),
+				main1: usingInputs(code1),
+			},
+			want: []gcDecision{
+				{main2, true, "old and unused"},
+				{main1, true, "old and unused"},
+				{code1, true, "old and unused"},
+			},
+		},
+		{
+			name:   "expired",
+			policy: gcPolicy{Expired: true, Keep: 5},
+			all:    []stacks.Stack{main1, main2, main3, routing},
+			metadata: map[stacks.Stack]stacks.Metadata{
+				main1:   {Expires: &past},
+				main2:   {Expires: &future},
+				routing: {Expires: &past},
+			},
+			want: []gcDecision{
+				{main1, true, "expired and unused"},
+				{routing, true, "expired and unused"},
+				{main2, false, "expires in"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.policy.decideFor(testInventory(tt.metadata, tt.outputs, tt.all...))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		ok := len(got) == len(tt.want)
+		for i := 0; ok && i < len(got); i++ {
+			ok = got[i].Stack == tt.want[i].Stack && got[i].Delete == tt.want[i].Delete &&
+				strings.HasPrefix(got[i].Reason, tt.want[i].Reason)
+		}
+		if !ok {
+			t.Errorf("%s: decisions = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/myhelix/terracanary/canarrors"
 	"github.com/myhelix/terracanary/stacks"
 	"github.com/spf13/cobra"
+	"os/exec"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 const passThroughUsage = " [-- <terraform-args>...]"
@@ -39,24 +43,30 @@ func parseStackArgs(cmd *cobra.Command, unversioned, versioned []string) (ret []
 		if str == "" {
 			continue
 		}
-		parts := strings.Split(str, ":")
-		if len(parts) < 2 || len(parts) > 3 {
+		if !strings.Contains(str, ":") {
 			cmd.Usage()
 			exitWith(canarrors.InvalidStack.Details("Versioned stack format is '<stack>:<version>[:<alias>]'."))
 		}
-		stack, err := stacks.Parse(parts[0], parts[1])
-		if err != nil {
-			cmd.Usage()
-			exitWith(err)
-		}
-		if len(parts) > 2 {
-			stack.InputAlias = parts[2]
-		}
-		ret = append(ret, stack)
+		ret = append(ret, parseStackString(cmd, str))
 	}
 	return
 }
 
+// Parses a stack given as '<stack>' or '<stack>:<version>' (or, for inputs, '<stack>:<version>:<alias>'), the same
+// way as pipelines do
+func parseStackString(cmd *cobra.Command, str string) stacks.Stack {
+	if str == "" {
+		cmd.Usage()
+		exitWith(canarrors.InvalidStack.Details("Empty stack name."))
+	}
+	stack, err := stacks.ParseString(str)
+	if err != nil {
+		cmd.Usage()
+		exitWith(err)
+	}
+	return stack
+}
+
 var unversionedStack string
 var versionedStack string
 var unversionedStacks []string
@@ -79,6 +89,35 @@ func takesInputStacks(cmd *cobra.Command) {
 	cmd.Flags().StringArrayVarP(&versionedInputStacks, "input-stack-version", "i", nil, "Stack version (as <stack>:<version>[:<alias>]) to provide state from as input; may repeat for multiple input stacks")
 }
 
+// Operations taking a run ID record their progress under it, so that rerunning them with the same run ID (e.g. when
+// a CI job is retried) carries on where they left off. Records of finished runs are pruned once they're older than
+// stacks.FinishedRunRetention.
+func takesRunID(cmd *cobra.Command, runID *string) {
+	cmd.Flags().StringVar(runID, "run-id", "", "ID under which to record progress, so that a rerun with the same ID resumes; finished runs are forgotten after "+retentionDays()+" days")
+}
+
+func retentionDays() string {
+	return strconv.Itoa(int(stacks.FinishedRunRetention.Hours() / 24))
+}
+
+// Value of --force when given without a file: destroy with the stack's own provider configuration. It can't be the
+// path of a file, so any file can be given with --force=<file>.
+const forceAuto = "\x00"
+
+func takesForce(cmd *cobra.Command, opts *destroyOptions) {
+	cmd.Flags().StringVarP(&opts.Force, "force", "f", "", "override prevent_destroy and bypass terraform definition/input errors, using only the given providers file, or if none is given, the stack's own provider configuration")
+	cmd.Flag("force").NoOptDefVal = forceAuto
+}
+
+// Since --force takes an optional value, "--force <file>" is a bare --force with the file left among the terraform
+// arguments; refuses arguments before "--" with a bare --force, rather than guessing which was meant
+func checkForceArgs(cmd *cobra.Command, opts destroyOptions, args []string) error {
+	if opts.Force == forceAuto && len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+		return fmt.Errorf("A providers file must be given as --force=<file>; give terraform arguments after \"--\".")
+	}
+	return nil
+}
+
 func passThroughCommand(cmd *cobra.Command, action string, args []string) {
 	stack := parseSingleStack(cmd)
 	inputStacks := parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
@@ -86,5 +125,26 @@ func passThroughCommand(cmd *cobra.Command, action string, args []string) {
 	exitIf(err)
 }
 
+// Exit code of a subprocess, given the error from running it; 128 plus the signal number if it was killed by a signal,
+// or 1 if it didn't get as far as exiting
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(interface {
+			Signaled() bool
+			Signal() syscall.Signal
+		}); ok && status.Signaled() {
+			// As the shell reports commands killed by a signal
+			return 128 + int(status.Signal())
+		}
+		if status, ok := exitErr.Sys().(interface{ ExitStatus() int }); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
 var exitIf = canarrors.ExitIf
 var exitWith = canarrors.ExitWith
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// A resource removed from a stack's state by --leave rather than destroyed, so still existing outside terraform
+type leftResource struct {
+	Stack   string
+	Address string
+	Type    string
+	ID      string
+	Pattern string // The --leave pattern it matched
+	Time    time.Time
+}
+
+func takesLeave(cmd *cobra.Command, opts *destroyOptions) {
+	cmd.Flags().StringArrayVarP(&opts.Leave, "leave", "l", []string{}, "skip destruction of resources matching pattern by removing them from state before destroy; may repeat")
+	cmd.Flags().StringVar(&opts.LeaveReport, "leave-report", "", "JSON file to add the resources removed from state by --leave to")
+}
+
+func readLeaveReport(path string) (report []leftResource, err error) {
+	jsn, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jsn, &report)
+	return
+}
+
+// Adds entries to the JSON report at path, creating it if need be
+func appendLeaveEntries(path string, entries []leftResource) error {
+	report, err := readLeaveReport(path)
+	if err != nil {
+		return err
+	}
+	jsn, err := json.MarshalIndent(append(report, entries...), "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(jsn, '\n'), 0644)
+}
+
+func appendLeaveReport(path string, stack stacks.Stack, patterns []string, removed []stacks.ResourceState) error {
+	now := time.Now().UTC()
+	var entries []leftResource
+	for _, r := range removed {
+		entries = append(entries, leftResource{
+			Stack:   stack.String(),
+			Address: r.Address,
+			Type:    r.Type,
+			ID:      r.ID,
+			Pattern: stacks.MatchingPattern(patterns, r.Address),
+			Time:    now,
+		})
+	}
+	log.Printf("Recording %d resource(s) left in place in %s\n", len(entries), path)
+	return appendLeaveEntries(path, entries)
+}
@@ -4,24 +4,55 @@ import (
 	"fmt"
 	"github.com/myhelix/terracanary/stacks"
 	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+	"time"
 )
 
 func init() {
+	var expired, long bool
+
 	//TODO: Support all flags from destroy for selecting stacks
 	var listCmd = &cobra.Command{
 		Use:   "list",
 		Short: "List all stacks",
-		Long:  `Outputs a list of stacks with existent state files, one per line, ordered by version.`,
-		Args:  cobra.NoArgs,
+		Long: `Outputs a list of stacks with existent state files, one per line, ordered by version.
+
+With --expired, only stacks applied with "terracanary apply --ttl" whose TTL has passed are listed.
+
+With --long, a table is output instead, giving each stack's state serial (incremented by terraform whenever it changes the state), number of resources, and when its state file was last written.`,
+		Args: cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			all, err := stacks.All("")
 			exitIf(err)
 
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			if long {
+				fmt.Fprintln(w, "STACK\tSERIAL\tRESOURCES\tMODIFIED")
+			}
 			for _, s := range all {
-				fmt.Println(s)
+				if expired {
+					meta, err := s.Metadata()
+					exitIf(err)
+					if !meta.Expired() {
+						continue
+					}
+				}
+				if !long {
+					fmt.Println(s)
+					continue
+				}
+				st, err := s.State()
+				exitIf(err)
+				modified, err := s.LastModified()
+				exitIf(err)
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", s, st.Serial, len(st.Resources), modified.UTC().Format(time.RFC3339))
 			}
+			exitIf(w.Flush())
 		},
 	}
 
+	listCmd.Flags().BoolVarP(&long, "long", "l", false, "output serial, resource count and modification time for each stack")
+	listCmd.Flags().BoolVar(&expired, "expired", false, "only list stacks whose TTL has expired")
 	RootCmd.AddCommand(listCmd)
 }
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"log"
+	"strings"
+)
+
+// Resources matching Pattern are moved to Stack
+type legacyMapping struct {
+	Pattern string
+	Stack   stacks.Stack
+}
+
+// Parses '<pattern>=<stack>' (or '<pattern> -> <stack>')
+func parseLegacyMapping(cmd *cobra.Command, str string) legacyMapping {
+	sep := "->"
+	i := strings.LastIndex(str, sep)
+	if i < 0 {
+		sep = "="
+		i = strings.LastIndex(str, sep)
+	}
+	if i <= 0 {
+		cmd.Usage()
+		exitWith(fmt.Errorf("Mapping must be '<address-pattern>=<stack>', not '%s'", str))
+	}
+	return legacyMapping{
+		Pattern: strings.TrimSpace(str[:i]),
+		Stack:   parseStackString(cmd, strings.TrimSpace(str[i+len(sep):])),
+	}
+}
+
+// Works out which stack each legacy resource goes to, using the first matching mapping. Returns the moves for each
+// destination stack (in the order the stacks first appear in the mappings), and the resources no mapping matched.
+func planLegacyMigration(state *stacks.State, mappings []legacyMapping) (targets []stacks.Stack, moves map[stacks.Stack][]stacks.ResourceMove, unmatched []string) {
+	moves = make(map[stacks.Stack][]stacks.ResourceMove)
+	for _, m := range mappings {
+		if _, ok := moves[m.Stack]; !ok {
+			targets = append(targets, m.Stack)
+			moves[m.Stack] = nil
+		}
+	}
+	for _, r := range state.Resources {
+		if r.Mode == stacks.DataMode {
+			// Data sources aren't worth moving; the destination stack's configuration reads them again
+			continue
+		}
+		matched := false
+		for _, m := range mappings {
+			if stacks.MatchAddress(m.Pattern, r.Address) {
+				moves[m.Stack] = append(moves[m.Stack], stacks.ResourceMove{From: r.Address})
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, r.Address)
+		}
+	}
+	return
+}
+
+func init() {
+	var mappingStrs []string
+	var dryRun bool
+
+	var migrateCmd = &cobra.Command{
+		Use:   "migrate-legacy --map <address-pattern>=<stack>... [--dry-run]",
+		Short: "Move resources from the legacy stack into terracanary stacks",
+		Long: `Splits the legacy stack (the state file at the base state file path, used before the project was managed by terracanary) up between terracanary stacks, by moving resources between state files rather than destroying and recreating them.
+
+Each --map gives an address pattern and the stack (unversioned, or as <stack>:<version>) that matching resources go to; each resource goes to the stack of the first pattern it matches. Patterns are matched as by "terracanary test": '*' and '?' are wildcards, a module address matches everything in it, and a resource address matches all its instances. Data sources are never moved. Resources that don't match any pattern are left in the legacy stack, which can then be destroyed with "terracanary destroy --legacy --force=<file> --leave ..." or migrated further.
+
+The resources moved are output as '<address> <stack>' lines; with --dry-run, nothing is changed, and the resources that would be moved are output instead. Moves are made with "terracanary state mv" (see its help for the backups and checks involved), one destination stack at a time, so an interrupted migration can simply be run again.
+
+The destination stacks' terraform configuration must of course declare the moved resources, at the same addresses, before they are next applied.`,
+		Example: `terracanary migrate-legacy --map 'aws_route53_record.*=routing' --map 'aws_db_instance.*=shared' --map 'module.app=main:1'`,
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(mappingStrs) == 0 {
+				cmd.Usage()
+				exitWith(canarrors.InvalidStack.Details("At least one --map is required."))
+			}
+			var mappings []legacyMapping
+			for _, str := range mappingStrs {
+				mappings = append(mappings, parseLegacyMapping(cmd, str))
+			}
+
+			exists, err := stacks.Legacy.Exists()
+			exitIf(err)
+			if !exists {
+				exitWith(canarrors.NoSuchStack.Details(stacks.Legacy))
+			}
+			state, err := stacks.Legacy.State()
+			exitIf(err)
+
+			targets, moves, unmatched := planLegacyMigration(state, mappings)
+			for _, target := range targets {
+				if len(moves[target]) == 0 {
+					log.Printf("Nothing to move to %s.\n", target)
+					continue
+				}
+				if !dryRun {
+					exitIf(stacks.MoveResources(stacks.Legacy, target, moves[target]))
+				}
+				for _, m := range moves[target] {
+					fmt.Println(m.From, target)
+				}
+			}
+			if len(unmatched) > 0 {
+				log.Println("Left in legacy stack:", unmatched)
+			}
+		},
+	}
+
+	migrateCmd.Flags().StringArrayVar(&mappingStrs, "map", nil, "'<address-pattern>=<stack>' moving matching resources to the stack; may repeat, first match wins")
+	migrateCmd.Flags().BoolVar(&dryRun, "dry-run", false, "output what would be moved without changing anything")
+	RootCmd.AddCommand(migrateCmd)
+}
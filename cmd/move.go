@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var overrides []string
+	var ignoreDependents bool
+
+	var moveCmd = &cobra.Command{
+		Use:   "move <stack>[:<version>] <stack>[:<version>]",
+		Short: "Give a stack's state a new name or version",
+		Long: `Moves the state of a stack to the state file of another stack that doesn't exist yet, along with terracanary's records about it, without changing any infrastructure. This can rename a stack (e.g. main:3 to edge:3), or convert between versioned and unversioned stacks (e.g. routing to routing:1).
+
+The state file is copied to its new location, and terraform is used to check that the copy lists the same resources, before the original is removed. If anything about the original state changes in the meantime, or the check fails, both copies are kept and terracanary exits with code ` + canarrors.StateChanged.ExitCodeString() + `.
+
+The destination needs a subdirectory with matching terraform configuration before it's next applied, and any variables derived from the stack's version (e.g. stack_version) will change to match the new identity. A stack protected by "terracanary protect" is only moved if given with --override-protection (its protection moves with it).
+
+Stacks that were last applied (or last successfully applied) with the stack as an input read its state from the old location, so they would break when next planned. They are listed, and terracanary exits with code ` + canarrors.HasDependents.ExitCodeString() + ` before moving anything, unless --ignore-dependents is given; they then need to be applied again with the new name.`,
+		Example: `terracanary move main:3 edge:3
+terracanary move routing routing:1`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			from := parseStackString(cmd, args[0])
+			to := parseStackString(cmd, args[1])
+
+			lookup := s3Lookup()
+			exitIf(checkProtection([]stacks.Stack{from}, parseOverrides(cmd, overrides), lookup.metadata))
+			if !ignoreDependents {
+				exitIf(checkDependents([]stacks.Stack{from}, lookup,
+					fmt.Sprint("use --ignore-dependents to move it anyway, then re-apply them with ", to)))
+			}
+			exitIf(from.MoveTo(to))
+		},
+	}
+
+	moveCmd.Flags().BoolVar(&ignoreDependents, "ignore-dependents", false, "move the stack even if other stacks were last applied with it as an input")
+	takesOverrideProtection(moveCmd, &overrides)
+	RootCmd.AddCommand(moveCmd)
+}
@@ -24,7 +24,9 @@ Is equivalent to:
 		terraform init -backend-config=key=<STATE_FILE_PATH>-main-5 ...
 		terraform output deployed_task_arn
 		terraform output log_group
-	)`,
+	)
+
+Except that string, number and bool outputs are read directly from the stack's state file where possible, without running terraform at all (otherwise they come from "terraform output -json"); either way, strings are output without surrounding whitespace. List and map outputs are printed by "terraform output" as before.`,
 		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			stack := parseSingleStack(cmd)
@@ -0,0 +1,607 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/cmd/util/aws"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Special targets for goto/on_exit
+const (
+	pipelineEnd  = "end"  // Stop the pipeline successfully
+	pipelineFail = "fail" // Stop the pipeline, exiting with the step's exit code
+)
+
+type pipeline struct {
+	Vars  map[string]string
+	Steps []pipelineStep
+
+	saved map[string]bool // Variables recorded in the run's checkpoint, so that they're restored when resuming
+}
+
+// Each step has exactly one action
+type pipelineStep struct {
+	Name   string
+	If     string            // Skip the step if this expands to the empty string
+	Goto   string            // Step to go to after succeeding, instead of the next one
+	OnExit map[string]string `yaml:"on_exit"` // Step to go to for a given exit code, or "*" for any other failure
+	Secret bool              // Don't record variables set by this step in the run's checkpoint
+
+	Apply   *pipelineApply
+	Test    *pipelineTest
+	Destroy *pipelineDestroy
+	Output  *pipelineOutput
+	Next    string           // Variable to store the next unused version number in
+	Set     yaml.MapSlice    // Variables to set, after expansion, in order
+	ECSRun  *pipelineECSRun  `yaml:"ecs_run"`
+	ECSWait *pipelineECSWait `yaml:"ecs_wait"`
+	Shell   *pipelineShell
+}
+
+type pipelineApply struct {
+	Stack  string
+	Inputs []string
+	Plan   string // Plan file saved by a test step (or "terracanary plan --out"); inputs and args not allowed
+	TTL    time.Duration
+	Args   []string
+}
+
+type pipelineTest struct {
+	Stack              string
+	Inputs             []string
+	IgnoreUpdate       []string `yaml:"ignore_update"`
+	StrictIgnoreUpdate bool     `yaml:"strict_ignore_update"`
+	AllowCreate        []string `yaml:"allow_create"`
+	AllowRead          bool     `yaml:"allow_read"`
+	IgnoreType         []string `yaml:"ignore_type"`
+	DenyReplace        []string `yaml:"deny_replace"`
+	Out                string
+	Args               []string
+}
+
+type pipelineDestroy struct {
+	Stacks           []string
+	All              []string
+	Except           []string
+	Legacy           bool
+	Everything       bool
+	Inputs           []string
+	Leave            []string
+	LeaveReport      string `yaml:"leave_report"`
+	Force            pipelineForce
+	SkipConfirmation bool `yaml:"skip_confirmation"`
+	DryRun           bool `yaml:"dry_run"`
+	Parallelism      int
+	Retries          *int     // Default as for destroy
+	RetryDelay       string   `yaml:"retry_delay"`
+	RetryBackoff     float64  `yaml:"retry_backoff"`
+	RetryRemaining   bool     `yaml:"retry_remaining"`
+	Override         []string `yaml:"override_protection"`
+	IgnoreDependents bool     `yaml:"ignore_dependents"`
+	Confirm          string
+	Args             []string
+}
+
+// A destroy step's force: a providers file, or true for the stack's own provider configuration (as a bare --force)
+type pipelineForce string
+
+func (f *pipelineForce) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var auto bool
+	if unmarshal(&auto) == nil {
+		if auto {
+			*f = forceAuto
+		}
+		return nil
+	}
+	return unmarshal((*string)(f))
+}
+
+type pipelineOutput struct {
+	Stack   string
+	Outputs map[string]string // Variable name => terraform output name
+}
+
+type pipelineECSRun struct {
+	Region    string
+	Cluster   string
+	TaskDef   string `yaml:"task_def"`
+	Container string
+	Command   []string
+	Timeout   time.Duration
+}
+
+type pipelineECSWait struct {
+	Region    string
+	Cluster   string
+	Instances string // May be a variable, so parsed after expansion
+	Service   string
+	Timeout   time.Duration
+}
+
+type pipelineShell struct {
+	Run     string
+	Capture string // Variable to store the command's (trimmed) stdout in
+}
+
+func loadPipeline(path string) (*pipeline, error) {
+	yml, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePipeline(path, yml)
+}
+
+func parsePipeline(path string, yml []byte) (*pipeline, error) {
+	p := &pipeline{}
+	err := yaml.UnmarshalStrict(yml, p)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing pipeline %s: %s", path, err)
+	}
+	if p.Vars == nil {
+		p.Vars = make(map[string]string)
+	}
+	p.saved = make(map[string]bool)
+	return p, p.validate()
+}
+
+// Checks that the pipeline is well-formed before running anything
+func (p *pipeline) validate() error {
+	names := map[string]bool{pipelineEnd: true, pipelineFail: true}
+	for i, step := range p.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("Pipeline step %d has no name", i+1)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("Pipeline step name '%s' is reserved or used more than once", step.Name)
+		}
+		names[step.Name] = true
+		if n := step.actions(); n != 1 {
+			return fmt.Errorf("Pipeline step '%s' must have exactly one action, found %d", step.Name, n)
+		}
+		for _, item := range step.Set {
+			if _, ok := item.Key.(string); !ok {
+				return fmt.Errorf("Pipeline step '%s' sets invalid variable name %v", step.Name, item.Key)
+			}
+			switch item.Value.(type) {
+			case yaml.MapSlice, []interface{}:
+				return fmt.Errorf("Pipeline step '%s' sets %s to something other than a string", step.Name, item.Key)
+			}
+		}
+	}
+	for _, step := range p.Steps {
+		if step.Goto != "" && !names[step.Goto] {
+			return fmt.Errorf("Pipeline step '%s' goes to unknown step '%s'", step.Name, step.Goto)
+		}
+		for code, target := range step.OnExit {
+			if _, err := strconv.Atoi(code); err != nil && code != "*" {
+				return fmt.Errorf("Pipeline step '%s' has invalid exit code '%s'", step.Name, code)
+			}
+			if !names[target] {
+				return fmt.Errorf("Pipeline step '%s' goes to unknown step '%s'", step.Name, target)
+			}
+		}
+	}
+	return nil
+}
+
+func (step pipelineStep) actions() (n int) {
+	for _, set := range []bool{
+		step.Apply != nil,
+		step.Test != nil,
+		step.Destroy != nil,
+		step.Output != nil,
+		step.Next != "",
+		step.Set != nil,
+		step.ECSRun != nil,
+		step.ECSWait != nil,
+		step.Shell != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	return
+}
+
+// Expands ${VAR} (or $VAR) using pipeline variables, falling back to the environment
+func (p *pipeline) expand(str string) string {
+	return os.Expand(str, func(name string) string {
+		if val, ok := p.Vars[name]; ok {
+			return val
+		}
+		return os.Getenv(name)
+	})
+}
+
+func (p *pipeline) expandAll(strs []string) (ret []string) {
+	for _, str := range strs {
+		ret = append(ret, p.expand(str))
+	}
+	return
+}
+
+func (p *pipeline) stack(str string) (stacks.Stack, error) {
+	return stacks.ParseString(p.expand(str))
+}
+
+func (p *pipeline) stackList(strs []string) (ret []stacks.Stack, err error) {
+	for _, str := range strs {
+		stack, err := p.stack(str)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, stack)
+	}
+	return
+}
+
+func (p *pipeline) index(name string) int {
+	for i, step := range p.Steps {
+		if step.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Runs the steps in order, following goto/on_exit; returns the error of the step that stopped the pipeline, if any.
+// Progress (the step to carry on from, and the variables set by non-secret next, set and output steps) is saved to the
+// checkpoint after each step, so a failed step is retried when the run is resumed.
+func (p *pipeline) run(cp *stacks.Checkpoint) error {
+	if cp.Finished {
+		log.Printf("Run %s already finished; nothing to do.\n", cp.RunID)
+		return nil
+	}
+	i := 0
+	if cp.Resumed() {
+		// Resolved values from the original run win, so that e.g. the same version is used
+		for name, val := range cp.Values {
+			p.setVar(name, val, true)
+		}
+		i = len(p.Steps)
+		if cp.Next != "" {
+			i = p.index(cp.Next)
+		}
+		if i < 0 {
+			return fmt.Errorf("Can't resume run %s; pipeline has no step %s", cp.RunID, cp.Next)
+		}
+	}
+
+	for i < len(p.Steps) {
+		step := p.Steps[i]
+		if step.If != "" && p.expand(step.If) == "" {
+			log.Printf("==> Skipping step: %s\n", step.Name)
+			i++
+			continue
+		}
+
+		log.Printf("==> Running step: %s\n", step.Name)
+		err := p.runStep(step, cp)
+		code := canarrors.ExitCode(err)
+
+		target, ok := step.OnExit[strconv.Itoa(code)]
+		if !ok && code != 0 {
+			target, ok = step.OnExit["*"]
+		}
+		if !ok {
+			if err != nil {
+				return err
+			}
+			target = step.Goto
+		}
+		if code != 0 {
+			log.Printf("Step %s exited with code %d (%s); going to: %s\n", step.Name, code, err, target)
+		}
+
+		switch target {
+		case "":
+			i++
+		case pipelineEnd:
+			i = len(p.Steps)
+		case pipelineFail:
+			if err == nil {
+				return fmt.Errorf("Pipeline failed at step %s", step.Name)
+			}
+			return err
+		default:
+			i = p.index(target)
+		}
+
+		cp.Next = ""
+		if i < len(p.Steps) {
+			cp.Next = p.Steps[i].Name
+		}
+		for name := range cp.Values {
+			if !p.saved[name] {
+				// Since overwritten by a variable that isn't saved
+				delete(cp.Values, name)
+			}
+		}
+		values := make(map[string]string)
+		for name := range p.saved {
+			values[name] = p.Vars[name]
+		}
+		err = cp.Complete(step.Name, values)
+		if err != nil {
+			return err
+		}
+	}
+	return cp.Finish()
+}
+
+// Sets a pipeline variable, and whether it's saved in the run's checkpoint
+func (p *pipeline) setVar(name, val string, save bool) {
+	p.Vars[name] = val
+	if save {
+		p.saved[name] = true
+	} else {
+		delete(p.saved, name)
+	}
+}
+
+// Destroys get their own run, so that a resumed destroy step skips the stacks already destroyed
+func destroyRunID(runID, step string) string {
+	if runID == "" {
+		return ""
+	}
+	return runID + "-" + step
+}
+
+func (p *pipeline) runStep(step pipelineStep, cp *stacks.Checkpoint) error {
+	switch {
+	case step.Apply != nil:
+		return p.runApply(step.Apply)
+	case step.Test != nil:
+		return p.runTest(step.Test)
+	case step.Destroy != nil:
+		return p.runDestroy(step.Destroy, destroyRunID(cp.RunID, step.Name))
+	case step.Output != nil:
+		return p.runOutput(step.Output, !step.Secret)
+	case step.Next != "":
+		next, err := stacks.Next("")
+		if err != nil {
+			return err
+		}
+		p.setVar(step.Next, fmt.Sprint(next), !step.Secret)
+		return nil
+	case step.Set != nil:
+		// In order, so that values can refer to variables set earlier in the step
+		for _, item := range step.Set {
+			val := ""
+			if item.Value != nil {
+				val = fmt.Sprint(item.Value)
+			}
+			p.setVar(item.Key.(string), p.expand(val), !step.Secret)
+		}
+		return nil
+	case step.ECSRun != nil:
+		a := step.ECSRun
+		return aws.RunTask(context.Background(), p.expand(a.Region), p.expand(a.Cluster), p.expand(a.TaskDef), p.expand(a.Container), p.expandAll(a.Command), a.Timeout)
+	case step.ECSWait != nil:
+		a := step.ECSWait
+		instances := int64(-1)
+		if expanded := p.expand(a.Instances); expanded != "" {
+			var err error
+			instances, err = strconv.ParseInt(expanded, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid instance count '%s': %s", expanded, err)
+			}
+		}
+		return aws.Wait(context.Background(), p.expand(a.Region), p.expand(a.Cluster), instances, p.expand(a.Service), a.Timeout)
+	case step.Shell != nil:
+		return p.runShell(step.Shell)
+	}
+	// Prevented by validate
+	return fmt.Errorf("No action for step %s", step.Name)
+}
+
+func (p *pipeline) runApply(a *pipelineApply) error {
+	stack, err := p.stack(a.Stack)
+	if err != nil {
+		return err
+	}
+	if a.Plan != "" {
+		if len(a.Inputs) > 0 || len(a.Args) > 0 {
+			return fmt.Errorf("Inputs and args can't be given when applying a saved plan; they are recorded in the plan.")
+		}
+		err = stack.ApplyPlan(p.expand(a.Plan))
+	} else {
+		var inputs []stacks.Stack
+		inputs, err = p.stackList(a.Inputs)
+		if err != nil {
+			return err
+		}
+		err = stack.Apply(inputs, p.expandAll(a.Args)...)
+	}
+	ttlErr := setExpiry(stack, a.TTL)
+	if err != nil {
+		return err
+	}
+	return ttlErr
+}
+
+func (p *pipeline) runTest(a *pipelineTest) error {
+	stack, err := p.stack(a.Stack)
+	if err != nil {
+		return err
+	}
+	inputs, err := p.stackList(a.Inputs)
+	if err != nil {
+		return err
+	}
+	policy := changePolicy{
+		IgnoreUpdate:       p.expandAll(a.IgnoreUpdate),
+		StrictIgnoreUpdate: a.StrictIgnoreUpdate,
+		AllowCreate:        p.expandAll(a.AllowCreate),
+		AllowRead:          a.AllowRead,
+		IgnoreType:         p.expandAll(a.IgnoreType),
+		DenyReplace:        p.expandAll(a.DenyReplace),
+	}
+	_, err = testStack(stack, inputs, policy, p.expand(a.Out), p.expandAll(a.Args))
+	return err
+}
+
+func (p *pipeline) runDestroy(a *pipelineDestroy, runID string) (err error) {
+	opts := destroyOptions{
+		All:              p.expandAll(a.All),
+		Legacy:           a.Legacy,
+		Everything:       a.Everything,
+		Leave:            p.expandAll(a.Leave),
+		LeaveReport:      p.expand(a.LeaveReport),
+		Force:            p.expand(string(a.Force)),
+		SkipConfirmation: a.SkipConfirmation,
+		DryRun:           a.DryRun,
+		Parallelism:      a.Parallelism,
+		RunID:            runID,
+		Args:             p.expandAll(a.Args),
+		Retry:            defaultRetry,
+		IgnoreDependents: a.IgnoreDependents,
+		Confirm:          p.expand(a.Confirm),
+	}
+	if a.Retries != nil {
+		opts.Retry.Retries = *a.Retries
+	}
+	if a.RetryDelay != "" {
+		if opts.Retry.Delay, err = time.ParseDuration(p.expand(a.RetryDelay)); err != nil {
+			return
+		}
+	}
+	if a.RetryBackoff != 0 {
+		opts.Retry.Backoff = a.RetryBackoff
+	}
+	opts.Retry.Remaining = a.RetryRemaining
+	if opts.Stacks, err = p.stackList(a.Stacks); err != nil {
+		return
+	}
+	if opts.Except, err = p.stackList(a.Except); err != nil {
+		return
+	}
+	if opts.Inputs, err = p.stackList(a.Inputs); err != nil {
+		return
+	}
+	if opts.Override, err = p.stackList(a.Override); err != nil {
+		return
+	}
+	return runDestroy(opts)
+}
+
+func (p *pipeline) runOutput(a *pipelineOutput, save bool) error {
+	stack, err := p.stack(a.Stack)
+	if err != nil {
+		return err
+	}
+	for varName, outputName := range a.Outputs {
+		val, err := stack.Output(p.expand(outputName))
+		if err != nil {
+			return err
+		}
+		p.setVar(varName, val, save)
+	}
+	return nil
+}
+
+func (p *pipeline) runShell(a *pipelineShell) error {
+	cmd := exec.Command("sh", "-c", a.Run)
+	cmd.Stderr = os.Stderr
+	// Keep stdout clean for data output
+	cmd.Stdout = os.Stderr
+	var out bytes.Buffer
+	if a.Capture != "" {
+		cmd.Stdout = &out
+	}
+	cmd.Env = os.Environ()
+	for name, val := range p.Vars {
+		cmd.Env = append(cmd.Env, name+"="+val)
+	}
+	err := cmd.Run()
+	if a.Capture != "" {
+		// Command output may well be sensitive, so it's never saved
+		p.setVar(a.Capture, strings.TrimSpace(out.String()), false)
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		// Pass through the command's exit code, so that it can be branched on
+		return canarrors.ErrorType{ExitCode: exitStatus(err), Description: "Shell command failed"}.Details(a.Run)
+	}
+	return err
+}
+
+func init() {
+	var vars []string
+	var runID string
+
+	var pipelineCmd = &cobra.Command{
+		Use:   "pipeline",
+		Short: "Run declarative deployment pipelines",
+	}
+
+	var runCmd = &cobra.Command{
+		Use:   "run <pipeline.yaml> [--var <name>=<value>...]",
+		Short: "Run the steps of a pipeline file",
+		Long: `Runs a deployment pipeline described in a YAML file. Each step has a name and exactly one action, and steps are run in order unless a step says otherwise. Actions are run within terracanary, just like the equivalent commands:
+
+	apply:    {stack, inputs, args, ttl} or {stack, plan, ttl}
+	test:     {stack, inputs, ignore_update, strict_ignore_update, allow_create, allow_read, ignore_type,
+	           deny_replace, out, args}
+	destroy:  {stacks, all, except, legacy, everything, inputs, leave, leave_report, force, skip_confirmation,
+	           dry_run, parallelism, retries, retry_delay, retry_backoff, retry_remaining, override_protection,
+	           ignore_dependents, confirm, args}
+	output:   {stack, outputs: {<variable>: <output-name>}}
+	next:     <variable>
+	set:      {<variable>: <value>, ...} (set in order, so later values can use earlier variables)
+	ecs_run:  {region, cluster, task_def, container, command, timeout}
+	ecs_wait: {region, cluster, instances, service, timeout}
+	shell:    {run, capture: <variable>}
+
+Stacks are given as on the command line, i.e. '<stack>', '<stack>:<version>', or for inputs '<stack>:<version>:<alias>'. A destroy step's force is a providers file, or true to use the stack's own provider configuration, as a bare --force does. Variables come from the "vars" map at the top of the file, --var, the output/next/capture of earlier steps, and finally the environment; they are expanded as ${NAME} in every action value except a shell step's run, which is left for the shell to expand, since variables are also set in the environment of shell steps.
+
+Steps may also have:
+
+	if:      skip the step unless this expands to a non-empty string
+	goto:    step to go to after the step succeeds, instead of the next one
+	on_exit: map from exit code (or "*" for any failure) to the step to go to
+	secret:  true to leave the variables the step sets out of the record of the run (see below)
+
+A shell step killed by a signal exits with code 128 plus the signal number (e.g. 143 for SIGTERM), as in the shell. The special step names "end" and "fail" stop the pipeline successfully, or with the step's exit code. A failing step not handled by on_exit stops the pipeline, and terracanary exits with its exit code.
+
+With --run-id, progress is recorded alongside the state files (in runs/<run-id>.json) after every step: the steps completed, the step to carry on from, and the current values of variables set by next, set and output steps, unless the step is marked secret. Variables from the file, --var and shell captures are never recorded. Rerunning the pipeline with the same run ID carries on from the step after the last one that completed (retrying a step that failed), with the recorded variables as they were at that point; for example, a "next" step that already ran isn't repeated, so the same version is used. Variables that weren't recorded (e.g. a secret output) aren't set by steps that already ran, so mark a step secret only if later steps don't need its variables when resuming. Once the pipeline has finished, rerunning it does nothing, until the record of the run is pruned ` + retentionDays() + ` days later. Note that files written by earlier steps (e.g. saved plans) must still be present when resuming.`,
+		Example: `terracanary pipeline run deploy.yaml --var RUN_MIGRATIONS=1
+
+# Part of a pipeline; see examples/ecs_blue_green/pipeline.yaml
+steps:
+  - name: test-main
+    test: {stack: "main:${MAIN_VERSION}", inputs: ["code:${NEW_VERSION}", shared], ignore_update: [aws_ecs_service.default]}
+    on_exit: {15: new-main}`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			p, err := loadPipeline(args[0])
+			exitIf(err)
+			for _, v := range vars {
+				parts := strings.SplitN(v, "=", 2)
+				if len(parts) != 2 {
+					exitWith(fmt.Errorf("Variables must be given as <name>=<value>, got: %s", v))
+				}
+				p.Vars[parts[0]] = parts[1]
+			}
+			cp, err := stacks.LoadCheckpoint(runID, "pipeline "+args[0])
+			exitIf(err)
+			exitIf(p.run(cp))
+			log.Println("Pipeline complete.")
+		},
+	}
+	runCmd.Flags().StringArrayVar(&vars, "var", nil, "set a pipeline variable, overriding the file; may repeat")
+	takesRunID(runCmd, &runID)
+	pipelineCmd.AddCommand(runCmd)
+	RootCmd.AddCommand(pipelineCmd)
+}
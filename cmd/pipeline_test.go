@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	tests := []struct {
+		name string
+		yml  string
+		err  string // Expected in the error; empty if the pipeline is valid
+	}{
+		{
+			name: "valid",
+			yml: `
+vars: {ENV: staging}
+steps:
+  - name: next
+    next: VERSION
+  - name: names
+    set: {STACK: "main:${VERSION}", COUNT: 3, ENABLED: true}
+  - name: apply
+    apply: {stack: "${STACK}", inputs: ["code:5:next"]}
+    on_exit: {"15": end, "*": cleanup}
+  - name: check
+    if: "${ENV}"
+    shell: {run: "curl -f https://example.com", capture: OUT}
+    goto: end
+  - name: cleanup
+    destroy: {stacks: ["${STACK}"], force: providers.tf, skip_confirmation: true}
+`,
+		},
+		{
+			name: "unknown action",
+			yml:  "steps:\n  - name: a\n    deploy: {stack: main}\n",
+			err:  "Error parsing pipeline",
+		},
+		{
+			name: "unknown action field",
+			yml:  "steps:\n  - name: a\n    apply: {stack: main, input: [code]}\n",
+			err:  "Error parsing pipeline",
+		},
+		{
+			name: "unknown top-level field",
+			yml:  "variables: {A: b}\nsteps: []\n",
+			err:  "Error parsing pipeline",
+		},
+		{
+			name: "no action",
+			yml:  "steps:\n  - name: a\n    goto: end\n",
+			err:  "exactly one action, found 0",
+		},
+		{
+			name: "two actions",
+			yml:  "steps:\n  - name: a\n    next: V\n    shell: {run: 'true'}\n",
+			err:  "exactly one action, found 2",
+		},
+		{
+			name: "no name",
+			yml:  "steps:\n  - next: V\n",
+			err:  "step 1 has no name",
+		},
+		{
+			name: "duplicate name",
+			yml:  "steps:\n  - name: a\n    next: V\n  - name: a\n    next: W\n",
+			err:  "used more than once",
+		},
+		{
+			name: "reserved name",
+			yml:  "steps:\n  - name: end\n    next: V\n",
+			err:  "reserved",
+		},
+		{
+			name: "unknown goto",
+			yml:  "steps:\n  - name: a\n    next: V\n    goto: b\n",
+			err:  "unknown step 'b'",
+		},
+		{
+			name: "unknown on_exit target",
+			yml:  "steps:\n  - name: a\n    next: V\n    on_exit: {\"1\": b}\n",
+			err:  "unknown step 'b'",
+		},
+		{
+			name: "invalid exit code",
+			yml:  "steps:\n  - name: a\n    next: V\n    on_exit: {x: end}\n",
+			err:  "invalid exit code 'x'",
+		},
+		{
+			name: "set to a list",
+			yml:  "steps:\n  - name: a\n    set: {A: [1, 2]}\n",
+			err:  "sets A to something other than a string",
+		},
+		{
+			name: "set to a map",
+			yml:  "steps:\n  - name: a\n    set: {A: {b: c}}\n",
+			err:  "sets A to something other than a string",
+		},
+		{
+			name: "set with a non-string name",
+			yml:  "steps:\n  - name: a\n    set: {[x]: y}\n",
+			err:  "invalid variable name",
+		},
+	}
+	for _, tt := range tests {
+		p, err := parsePipeline("test.yaml", []byte(tt.yml))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", tt.name, err)
+			} else if p.Vars == nil {
+				t.Errorf("%s: no vars map", tt.name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestPipelineForce(t *testing.T) {
+	tests := map[string]pipelineForce{
+		"true":             forceAuto,
+		"false":            "",
+		"providers.tf":     "providers.tf",
+		"'true'":           "true",
+		"'${DIR}/main.tf'": "${DIR}/main.tf",
+	}
+	for value, want := range tests {
+		p, err := parsePipeline("test.yaml", []byte("steps:\n  - name: a\n    destroy: {legacy: true, force: "+value+"}\n"))
+		if err != nil {
+			t.Errorf("force: %s: unexpected error %s", value, err)
+		} else if got := p.Steps[0].Destroy.Force; got != want {
+			t.Errorf("force: %s = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestPipelineSetOrder(t *testing.T) {
+	p, err := parsePipeline("test.yaml", []byte("steps:\n  - name: a\n    set: {B: 1, A: '${B}', C: x}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []interface{}
+	for _, item := range p.Steps[0].Set {
+		keys = append(keys, item.Key)
+	}
+	if want := []interface{}{"B", "A", "C"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("set keys = %v, want %v", keys, want)
+	}
+}
+
+func TestDestroyRunID(t *testing.T) {
+	tests := []struct {
+		runID, step string
+		want        string
+	}{
+		{"", "cleanup", ""},
+		{"deploy-42", "cleanup", "deploy-42-cleanup"},
+		{"deploy-42", "destroy-old", "deploy-42-destroy-old"},
+	}
+	for _, tt := range tests {
+		if got := destroyRunID(tt.runID, tt.step); got != tt.want {
+			t.Errorf("destroyRunID(%q, %q) = %q, want %q", tt.runID, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestPipelineSavedVars(t *testing.T) {
+	p, err := parsePipeline("test.yaml", []byte(`
+vars: {ENV: staging}
+steps:
+  - name: version
+    set: {VERSION: 3, TOKEN: abc}
+  - name: token
+    set: {TOKEN: s3cret}
+    secret: true
+  - name: capture
+    shell: {run: "echo hello", capture: OUT}
+  - name: tag
+    set: {TAG: "${OUT}-${VERSION}-${ENV}"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := stacks.LoadCheckpoint("", "pipeline test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.run(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"VERSION": "3", "TAG": "hello-3-staging"}; !reflect.DeepEqual(cp.Values, want) {
+		t.Errorf("checkpoint values = %v, want %v", cp.Values, want)
+	}
+	if p.Vars["TOKEN"] != "s3cret" || p.Vars["OUT"] != "hello" {
+		t.Errorf("unsaved variables not set: %v", p.Vars)
+	}
+}
+
+func TestShellSignalExitCode(t *testing.T) {
+	p := &pipeline{Vars: make(map[string]string), saved: make(map[string]bool)}
+	err := p.runShell(&pipelineShell{Run: "kill -TERM $$"})
+	if code := canarrors.ExitCode(err); code != 143 {
+		t.Errorf("exit code = %d (%v), want 143", code, err)
+	}
+}
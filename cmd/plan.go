@@ -5,16 +5,31 @@ import (
 )
 
 func init() {
+	var out string
+
 	var planCmd = &cobra.Command{
 		Use: "plan" + singleStackUsage + passThroughUsage,
 		DisableFlagsInUseLine: true,
 		Short: "Plan changes to a stack",
-		Long:  `Runs "terraform plan" on the specified stack, displaying the output on stderr. To get accurate results, be sure to include the exact arguments you would specify to "terracanary apply" (e.g. input stacks).`,
+		Long: `Runs "terraform plan" on the specified stack, displaying the output on stderr. To get accurate results, be sure to include the exact arguments you would specify to "terracanary apply" (e.g. input stacks).
+
+With --out, the plan is saved to the given file, along with a record (in <file>.json) of the stack, input stacks and arguments it was planned with. That exact plan can then be applied with "terracanary apply --plan <file>".`,
+		Example: `terracanary plan -s main:5 -i code:5 --out main.plan
+terracanary apply -s main:5 --plan main.plan`,
 		Run: func(cmd *cobra.Command, args []string) {
-			passThroughCommand(cmd, "plan", args)
+			if out == "" {
+				passThroughCommand(cmd, "plan", args)
+				return
+			}
+			stack := parseSingleStack(cmd)
+			inputStacks := parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
+			_, err := stack.SavePlan(out, inputStacks, args...)
+			exitIf(err)
 		},
 	}
 
+	planCmd.Flags().StringVar(&out, "out", "", "save the plan to this file, to be applied later with 'apply --plan'")
+
 	takesSingleStack(planCmd)
 	takesInputStacks(planCmd)
 	RootCmd.AddCommand(planCmd)
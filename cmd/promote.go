@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"log"
+	"strings"
+)
+
+func inputStrings(inputs []stacks.Stack) string {
+	var strs []string
+	for _, i := range inputs {
+		strs = append(strs, i.InputString())
+	}
+	return strings.Join(strs, " ")
+}
+
+// Re-applies the routing stack with the inputs it was last applied with, except that the new stack replaces the
+// inputs with the given aliases (or, if none are given, any inputs from the same subdir). Aliases that weren't
+// previously used are added. If no args are given, the args from the last apply are reused. If terracanary has no
+// record of applying the routing stack (e.g. on the first deployment), it's simply applied with the new stack as
+// each of the given aliases, and nothing is recorded for rollback.
+func promote(routing, stack stacks.Stack, aliases []string, args []string) error {
+	meta, err := routing.Metadata()
+	if err != nil {
+		return err
+	}
+	if meta.LastApply == nil {
+		if len(aliases) == 0 {
+			return canarrors.NoHistory.Details("no recorded apply of ", routing, "; use --as to name its inputs, or apply it with terracanary first")
+		}
+		var inputs []stacks.Stack
+		for _, a := range aliases {
+			input := stack
+			input.InputAlias = a
+			inputs = append(inputs, input)
+		}
+		log.Printf("No recorded apply of %s; applying it with inputs: %s (nothing to roll back to)\n", routing, inputStrings(inputs))
+		return routing.Apply(inputs, args...)
+	}
+	from := meta.LastApply.Inputs
+	fromArgs := meta.LastApply.Args
+	if len(args) == 0 {
+		args = fromArgs
+	}
+	to, err := promotedInputs(routing, stack, aliases, from)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Promoting %s in %s; inputs were: %s; will be: %s\n", stack, routing, inputStrings(from), inputStrings(to))
+	return routing.Promote(from, to, fromArgs, args...)
+}
+
+// The routing stack's inputs with stack promoted: replacing the inputs with the given aliases (adding any it didn't
+// have), or with no aliases, those from the same stack
+func promotedInputs(routing, stack stacks.Stack, aliases []string, from []stacks.Stack) (to []stacks.Stack, err error) {
+	used := make(map[string]bool)
+	for _, input := range from {
+		replace := false
+		if len(aliases) == 0 {
+			replace = input.Subdir == stack.Subdir
+		} else {
+			for _, a := range aliases {
+				if input.InputAlias == a {
+					replace = true
+				}
+			}
+		}
+		if replace {
+			used[input.InputAlias] = true
+			input.Subdir = stack.Subdir
+			input.Version = stack.Version
+		}
+		to = append(to, input)
+	}
+	for _, a := range aliases {
+		if !used[a] {
+			added := stack
+			added.InputAlias = a
+			to = append(to, added)
+			used[a] = true
+		}
+	}
+	if len(used) == 0 {
+		return nil, canarrors.InvalidStack.Details(routing, " has no ", stack.Subdir, " input to replace; use --as to name one")
+	}
+	return
+}
+
+func init() {
+	var routingName, stackName string
+	var aliases []string
+
+	var promoteCmd = &cobra.Command{
+		Use:                   "promote --routing <stack> --stack <stack>:<version> [--as <alias>...]" + passThroughUsage,
+		DisableFlagsInUseLine: true,
+		Short:                 "Re-apply a routing stack with a new version of one of its inputs",
+		Long: `Re-applies the routing stack with the input stacks recorded from its last apply, replacing one of them with the given stack version. With --as, the inputs with that alias are replaced (or added, if the routing stack didn't have them); otherwise any inputs from the same stack as the new version are replaced, keeping their aliases.
+
+The terraform arguments from the last apply are reused, unless new ones are given. The previous inputs and arguments are recorded before applying (so even a promotion that fails part way can be rolled back), so that "terracanary rollback" can restore them.
+
+If terracanary has no record of applying the routing stack (on the first deployment, or for a routing stack last applied by an older terracanary), it is simply applied with the promoted stack as each of the --as aliases, which must then name every input it needs; there is nothing to roll back to.`,
+		Example: `terracanary promote --routing routing --stack main:13 --as next
+terracanary promote --routing routing --stack main:13 --as current --as next
+terracanary rollback --routing routing`,
+		Run: func(cmd *cobra.Command, args []string) {
+			routing := parseStackString(cmd, routingName)
+			stack := parseStackString(cmd, stackName)
+			exitIf(promote(routing, stack, aliases, args))
+		},
+	}
+	promoteCmd.Flags().StringVar(&routingName, "routing", "", "Routing stack to re-apply, as <stack> or <stack>:<version> (required)")
+	promoteCmd.Flags().StringVar(&stackName, "stack", "", "Stack version to promote, as <stack>:<version> (required)")
+	promoteCmd.Flags().StringArrayVar(&aliases, "as", nil, "Input alias to replace with the promoted stack; may repeat")
+	promoteCmd.MarkFlagRequired("routing")
+	promoteCmd.MarkFlagRequired("stack")
+	RootCmd.AddCommand(promoteCmd)
+
+	var rollbackCmd = &cobra.Command{
+		Use:   "rollback --routing <stack>",
+		Short: "Undo the last promotion of a routing stack",
+		Long:  `Re-applies the routing stack with the input stacks (and terraform arguments) it had before its most recent "terracanary promote", whether or not that promotion's apply succeeded, and forgets that promotion; running rollback again goes back another promotion. Exits with code ` + canarrors.NoHistory.ExitCodeString() + ` if there is no promotion to roll back.`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			routing := parseStackString(cmd, routingName)
+			rolledBack, err := routing.Rollback()
+			exitIf(err)
+			log.Println("Rolled back to:", inputStrings(rolledBack.From))
+		},
+	}
+	rollbackCmd.Flags().StringVar(&routingName, "routing", "", "Routing stack to roll back, as <stack> or <stack>:<version> (required)")
+	rollbackCmd.MarkFlagRequired("routing")
+	RootCmd.AddCommand(rollbackCmd)
+}
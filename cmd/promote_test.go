@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"reflect"
+	"testing"
+)
+
+func TestPromotedInputs(t *testing.T) {
+	routing := stacks.New("routing", 0)
+	main13 := stacks.New("main", 13)
+	aliased := func(subdir string, version uint, alias string) stacks.Stack {
+		return stacks.Stack{Subdir: subdir, Version: version, InputAlias: alias}
+	}
+	shared := stacks.New("shared", 0)
+
+	tests := []struct {
+		name    string
+		aliases []string
+		from    []stacks.Stack
+		want    []stacks.Stack // nil for an InvalidStack error
+	}{
+		{
+			name:    "replace by alias",
+			aliases: []string{"next"},
+			from:    []stacks.Stack{aliased("main", 11, "current"), aliased("main", 12, "next"), shared},
+			want:    []stacks.Stack{aliased("main", 11, "current"), aliased("main", 13, "next"), shared},
+		},
+		{
+			name:    "replace several aliases",
+			aliases: []string{"current", "next"},
+			from:    []stacks.Stack{aliased("main", 11, "current"), aliased("main", 12, "next")},
+			want:    []stacks.Stack{aliased("main", 13, "current"), aliased("main", 13, "next")},
+		},
+		{
+			name:    "add a missing alias",
+			aliases: []string{"next"},
+			from:    []stacks.Stack{aliased("main", 11, "current"), shared},
+			want:    []stacks.Stack{aliased("main", 11, "current"), shared, aliased("main", 13, "next")},
+		},
+		{
+			name:    "alias may come from another stack",
+			aliases: []string{"backend"},
+			from:    []stacks.Stack{aliased("code", 4, "backend")},
+			want:    []stacks.Stack{aliased("main", 13, "backend")},
+		},
+		{
+			name: "replace by stack, keeping aliases",
+			from: []stacks.Stack{aliased("main", 11, "current"), aliased("main", 12, "next"), shared},
+			want: []stacks.Stack{aliased("main", 13, "current"), aliased("main", 13, "next"), shared},
+		},
+		{
+			name: "replace unaliased input",
+			from: []stacks.Stack{stacks.New("main", 12), shared},
+			want: []stacks.Stack{main13, shared},
+		},
+		{
+			name: "nothing to replace",
+			from: []stacks.Stack{aliased("code", 4, "backend"), shared},
+		},
+	}
+	for _, tt := range tests {
+		from := append([]stacks.Stack{}, tt.from...)
+		got, err := promotedInputs(routing, main13, tt.aliases, tt.from)
+		if tt.want == nil {
+			if !canarrors.Is(err, canarrors.InvalidStack) {
+				t.Errorf("%s: got %v, %v; want an InvalidStack error", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: inputs = %v, want %v", tt.name, inputStrings(got), inputStrings(tt.want))
+		}
+		if !reflect.DeepEqual(tt.from, from) {
+			t.Errorf("%s: changed the original inputs to %v", tt.name, inputStrings(tt.from))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+func takesOverrideProtection(cmd *cobra.Command, overrides *[]string) {
+	cmd.Flags().StringArrayVar(overrides, "override-protection", nil, "allow the given stack ('<stack>' or '<stack>:<version>') to be changed even though it's protected; may repeat")
+}
+
+func parseOverrides(cmd *cobra.Command, overrides []string) (ret []stacks.Stack) {
+	for _, str := range overrides {
+		ret = append(ret, parseStackString(cmd, str))
+	}
+	return
+}
+
+func overridden(s stacks.Stack, overrides []stacks.Stack) bool {
+	for _, o := range overrides {
+		if o.String() == s.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails with a Protected error if any of the stacks is protected (see "terracanary protect"), unless its protection
+// is overridden; metadata is normally stacks.Stack.Metadata
+func checkProtection(list []stacks.Stack, overrides []stacks.Stack, metadata func(stacks.Stack) (stacks.Metadata, error)) error {
+	for _, s := range list {
+		meta, err := metadata(s)
+		if err != nil {
+			return err
+		}
+		if meta.Protected == nil {
+			continue
+		}
+		if overridden(s, overrides) {
+			log.Printf("Overriding protection of %s\n", s)
+			continue
+		}
+		details := []interface{}{s, " (since ", meta.Protected.Time.Format("2006-01-02 15:04"), ")"}
+		if meta.Protected.Reason != "" {
+			details = append(details, ": ", meta.Protected.Reason)
+		}
+		return canarrors.Protected.Details(append(details, "; use --override-protection ", s, " if you're sure")...)
+	}
+	return nil
+}
+
+func init() {
+	var reason string
+
+	var protectCmd = &cobra.Command{
+		Use:   "protect <stack>[:<version>] [--reason <text>]",
+		Short: "Protect a stack against being destroyed or moved",
+		Long: `Records that the stack (typically the live version of a versioned stack) is protected. Until "terracanary unprotect" is run, "terracanary destroy" and "terracanary move" refuse to touch it, exiting with code ` + canarrors.Protected.ExitCodeString() + `, and "terracanary gc" keeps it (and so whatever it uses), unless they are given --override-protection with that stack.
+
+Protection is recorded alongside the state files, so it applies to every terracanary user. Unlike the confirmation "terracanary destroy" asks for when removing all versions of a stack, it can't be bypassed by --skip-confirmation.`,
+		Example: `terracanary protect main:12 --reason "live"
+terracanary destroy -s main:12 --override-protection main:12`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			stack := parseStackString(cmd, args[0])
+			exitIf(stack.Protect(reason))
+			log.Println("Protected:", stack)
+		},
+	}
+	protectCmd.Flags().StringVar(&reason, "reason", "", "why the stack is protected, shown when refusing to touch it")
+	RootCmd.AddCommand(protectCmd)
+
+	var unprotectCmd = &cobra.Command{
+		Use:   "unprotect <stack>[:<version>]",
+		Short: "Remove protection from a stack",
+		Long:  `Removes the protection recorded by "terracanary protect", so that the stack can be destroyed or moved as usual. Does nothing if the stack isn't protected.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			stack := parseStackString(cmd, args[0])
+			exitIf(stack.Unprotect())
+			log.Println("Unprotected:", stack)
+		},
+	}
+	RootCmd.AddCommand(unprotectCmd)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverridden(t *testing.T) {
+	overrides := []stacks.Stack{stacks.New("main", 3), stacks.New("routing", 0)}
+	tests := []struct {
+		stack stacks.Stack
+		want  bool
+	}{
+		{stacks.New("main", 3), true},
+		{stacks.Stack{Subdir: "main", Version: 3, InputAlias: "current"}, true},
+		{stacks.New("main", 4), false},
+		{stacks.New("routing", 0), true},
+		{stacks.New("routing", 1), false},
+	}
+	for _, tt := range tests {
+		if got := overridden(tt.stack, overrides); got != tt.want {
+			t.Errorf("overridden(%v) = %v, want %v", tt.stack, got, tt.want)
+		}
+	}
+}
+
+func TestProtectionBlocksDestroy(t *testing.T) {
+	main3, main4, routing := stacks.New("main", 3), stacks.New("main", 4), stacks.New("routing", 0)
+	lookup := fakeLookup([]stacks.Stack{main3, main4, routing}, map[stacks.Stack]stacks.Metadata{
+		main4:   {Protected: &stacks.Protection{Time: time.Now(), Reason: "live"}},
+		routing: {Protected: &stacks.Protection{Time: time.Now()}},
+	})
+
+	tests := []struct {
+		name      string
+		destroy   []stacks.Stack
+		overrides []stacks.Stack
+		protected string // Stack named in the expected error; empty if destroying is allowed
+	}{
+		{"unprotected", []stacks.Stack{main3}, nil, ""},
+		{"protected", []stacks.Stack{main3, main4}, nil, "main:4"},
+		{"reason reported", []stacks.Stack{main4}, nil, "live"},
+		{"overridden", []stacks.Stack{main4}, []stacks.Stack{main4}, ""},
+		{"other protected stack not overridden", []stacks.Stack{main4, routing}, []stacks.Stack{main4}, "routing"},
+		{"override for another version", []stacks.Stack{main4}, []stacks.Stack{main3}, "main:4"},
+		{"dependents ignored, protection isn't", []stacks.Stack{routing}, nil, "routing"},
+	}
+	for _, tt := range tests {
+		err := checkDestroyable(tt.destroy, destroyOptions{Override: tt.overrides, IgnoreDependents: true}, lookup)
+		if tt.protected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", tt.name, err)
+			}
+			continue
+		}
+		if !canarrors.Is(err, canarrors.Protected) {
+			t.Errorf("%s: got %v, want a Protected error", tt.name, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.protected) {
+			t.Errorf("%s: error %q doesn't mention %s", tt.name, err, tt.protected)
+		}
+	}
+}
@@ -3,8 +3,11 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/myhelix/terracanary/canarrors"
 	"github.com/myhelix/terracanary/config"
+	"github.com/myhelix/terracanary/stacks"
 	"github.com/spf13/cobra"
 )
 
@@ -12,7 +15,9 @@ import (
 var RootCmd = &cobra.Command{
 	Use:   "terracanary",
 	Short: "Deployment orchestration using terraform",
-	Long:  `Terracanary provides a wrapper for terraform that manages multiple versions of terraform stacks and facilitates sharing data between multiple related stacks. This allows you to easily construct complex deployment procedures.`,
+	Long: `Terracanary provides a wrapper for terraform that manages multiple versions of terraform stacks and facilitates sharing data between multiple related stacks. This allows you to easily construct complex deployment procedures.
+
+Terraform keeps the backend configuration for a directory in its .terraform subdirectory, so only one version of a stack can be initialized in a directory at a time. By default, terracanary runs terraform directly in each stack's directory, and locks it until it exits; other terracanary processes using the same directory wait for the lock, for up to --lock-timeout, before exiting with code ` + canarrors.Timeout.ExitCodeString() + `. With --isolated, each terracanary process instead runs terraform in its own temporary copy of each stack's directory (with everything else in the project symlinked), sharing downloaded providers via terraform's plugin cache, so that processes can run concurrently.`,
 	Example: `# Apply database infrastructure updates
 terracanary apply --stack database
 # Run database migrations
@@ -29,22 +34,34 @@ terracanary apply --stack routing --input-stack-version main:$NEW_VERSION
 terracanary destroy --all main --except main:$NEW_VERSION`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		exitIf(config.Read())
+		stacks.IsolatedWorkdirs = isolated
+		stacks.LockTimeout = lockTimeout
 		return nil
 	},
 }
 
+var isolated bool
+var lockTimeout time.Duration
+
 func init() {
 	RootCmd.SetHelpTemplate(`Description:
 
 {{with (or .Long .Short)}}{{. | trimTrailingWhitespaces}}
 {{end}}
 {{if or .Runnable .HasSubCommands}}{{.UsageString}}{{end}}`)
+
+	RootCmd.PersistentFlags().BoolVar(&isolated, "isolated", os.Getenv("TERRACANARY_ISOLATED") != "",
+		"run terraform in a private copy of each stack's directory, so that other terracanary processes in the same checkout can't interfere (default $TERRACANARY_ISOLATED)")
+	RootCmd.PersistentFlags().DurationVar(&lockTimeout, "lock-timeout", stacks.LockTimeout,
+		"how long to wait for another terracanary process to finish using a stack's directory")
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the RootCmd.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	err := RootCmd.Execute()
+	canarrors.RunExitHooks()
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
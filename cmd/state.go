@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var from, to string
+
+	var stateCmd = &cobra.Command{
+		Use:   "state",
+		Short: "Work with the state of stacks",
+	}
+
+	var mvCmd = &cobra.Command{
+		Use:   "mv --from <stack> --to <stack> <address> [<new-address>]",
+		Short: "Move resources from one stack's state to another's",
+		Long: `Moves the resource or module at the given address from the state of one stack to that of another, optionally giving it a new address, in the same way that "terraform state mv" does within a single state. Nothing is created or destroyed; the destination stack simply takes over management of the resources, for example when promoting a resource from a versioned stack into a shared unversioned one. The destination stack doesn't need to exist yet.
+
+Both states are pulled, and backed up in the state file bucket under "terracanary-backups/<key>/<stack>/" (where <key> is the state file key given to "terracanary init"; the backup locations are logged) before anything changes. Backups are never removed by terracanary; to prune them, add an S3 lifecycle rule expiring objects under the "terracanary-backups/" prefix of the bucket.
+
+The move is made on local copies, which are pushed back (destination first) if neither state has changed in the meantime; otherwise terracanary exits with code ` + canarrors.StateChanged.ExitCodeString() + `, as it does if the pushed states don't turn out as expected. If pushing the source state fails after the destination's was pushed, the resources are in both states: the new source state is saved alongside the backups, the commands to push it are logged, and terracanary exits with code ` + canarrors.StateChanged.ExitCodeString() + `. Both stack directories are locked while this happens (see "terracanary --help").
+
+The moved resources must also be moved between the stacks' terraform configuration, or the next apply of each stack will destroy or recreate them.`,
+		Example: `terracanary state mv --from code:11 --to shared aws_s3_bucket.assets
+terracanary state mv --from main:3 --to edge module.cdn module.edge_cdn`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if from == "" || to == "" {
+				cmd.Usage()
+				exitWith(canarrors.InvalidStack.Details("Both --from and --to are required."))
+			}
+			move := stacks.ResourceMove{From: args[0]}
+			if len(args) > 1 {
+				move.To = args[1]
+			}
+			err := stacks.MoveResources(parseStackString(cmd, from), parseStackString(cmd, to), []stacks.ResourceMove{move})
+			exitIf(err)
+		},
+	}
+
+	mvCmd.Flags().StringVar(&from, "from", "", "stack ('<stack>' or '<stack>:<version>') to move the resources out of")
+	mvCmd.Flags().StringVar(&to, "to", "", "stack ('<stack>' or '<stack>:<version>') to move the resources into")
+	stateCmd.AddCommand(mvCmd)
+	RootCmd.AddCommand(stateCmd)
+}
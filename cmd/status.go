@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/myhelix/terracanary/stacks"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+func init() {
+	var skipResources bool
+
+	var statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show an overview of all stacks",
+		Long: `Outputs a table describing every existing stack version, grouped by stack: its age, how many resources are in its state, whether its last apply succeeded, and which other stacks refer to it. A stack is referred to by stacks last applied with it as an input, by stacks whose last promotion replaced it (i.e. what "terracanary rollback" would restore), and by outputs of other stacks pointing at its version (e.g. a routing stack's main_stack_version output); these are the same references that stop "terracanary gc" from collecting it.
+
+Age and apply results come from the records terracanary keeps when running "terracanary apply"; stacks last applied by older versions of terracanary will show the age of their state file and an unknown apply result.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			all, err := stacks.All("")
+			exitIf(err)
+			sort.SliceStable(all, func(i, j int) bool {
+				return all[i].Subdir < all[j].Subdir
+			})
+
+			inv, err := gcInventoryOf(all)
+			exitIf(err)
+			for _, s := range all {
+				exitIf(inv.scanPointers(s))
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "STACK\tAGE\tRESOURCES\tLAST APPLY\tREFERENCED BY")
+			for i, s := range all {
+				if i > 0 && s.Subdir != all[i-1].Subdir {
+					fmt.Fprintln(w, "\t\t\t\t")
+				}
+				meta := inv.metadata[s]
+
+				created, err := inv.created(s)
+				exitIf(err)
+
+				resources := "-"
+				if !skipResources {
+					list, err := s.StateList()
+					exitIf(err)
+					resources = fmt.Sprint(len(list))
+				}
+
+				lastApply := "unknown"
+				if meta.LastApply != nil {
+					result := "succeeded"
+					if !meta.LastApply.Success {
+						result = "FAILED"
+					}
+					lastApply = fmt.Sprintf("%s %s ago", result, formatAge(time.Since(meta.LastApply.Time)))
+				}
+
+				var referencedBy []string
+				for _, ref := range inv.referrers(s) {
+					referencedBy = append(referencedBy, ref.String())
+				}
+				referencedBy = append(referencedBy, inv.pointers[s]...)
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					s, formatAge(time.Since(created)), resources, lastApply, strings.Join(referencedBy, ", "))
+			}
+			exitIf(w.Flush())
+		},
+	}
+
+	statusCmd.Flags().BoolVar(&skipResources, "skip-resources", false, "don't count resources in each stack")
+	RootCmd.AddCommand(statusCmd)
+}
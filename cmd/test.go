@@ -1,15 +1,54 @@
 package cmd
 
 import (
-	"bytes"
-	"github.com/hashicorp/terraform/terraform"
+	"encoding/json"
+	"fmt"
 	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/stacks"
 	"github.com/spf13/cobra"
 	"log"
 )
 
+type testReport struct {
+	Stack   string
+	Changes []changeVerdict
+	Denied  int
+}
+
+// Plans the stack and checks every change against the policy, logging a report of all of them; returns a
+// PlanHasChanges error if any change isn't allowed. If out is set, the plan is saved there.
+func testStack(stack stacks.Stack, inputStacks []stacks.Stack, policy changePolicy, out string, args []string) (report testReport, err error) {
+	report.Stack = stack.String()
+
+	// See what would happen if we applied to existing stack
+	changes, err := stack.PlannedChanges(out, inputStacks, args...)
+	if err != nil {
+		return
+	}
+	report.Changes, report.Denied = policy.evaluateAll(changes)
+
+	log.Printf("Planned changes for %s:\n", stack)
+	for _, c := range report.Changes {
+		verdict := "allowed"
+		if !c.Allowed {
+			verdict = "DENIED"
+		}
+		log.Printf("\t%-7s  %-7s  %s (%s)\n", verdict, c.Action, c.Address, c.Reason)
+	}
+	if len(report.Changes) == 0 {
+		log.Println("\tnone")
+	}
+
+	if report.Denied > 0 {
+		err = canarrors.PlanHasChanges.Details(report.Denied, " of ", len(report.Changes), " changes not allowed")
+	}
+	return
+}
+
 func init() {
-	var ignoreUpdate []string
+	var policy changePolicy
+	var out string
+	var jsonReport bool
 
 	var testCmd = &cobra.Command{
 		Use: "test" + singleStackUsage + passThroughUsage,
@@ -17,45 +56,44 @@ func init() {
 		Short: "Check if there are any changes to a stack",
 		Long: `Uses "terraform plan" to check if any changes are needed for the specified stack. To get accurate results, be sure to include the exact arguments you would specify to "terracanary apply" (e.g. input stacks).
 
+Every planned change is checked against the flags below, and a report of all of them (and whether each was allowed) is logged before exiting. With --json, the report is also written to stdout as JSON. Resource patterns are matched against full resource addresses (as shown by "terraform state list"); '*' matches any run of characters, a pattern naming a module matches every resource in it, and a pattern without an index matches every instance of a counted resource. Replacements matching --deny-replace are never allowed, even if the resource type is ignored. Data sources to be read during apply count as changes unless --allow-read is given.
+
+An --ignore-update pattern that doesn't start with "module." also matches resources of that name inside any module (e.g. aws_ecs_service.default matches module.app.aws_ecs_service.default), unless --strict-ignore-update is given.
+
+Plans from terraform 0.12 and later are read using "terraform show -json"; older plan files are decoded directly.
+
+With --out, the tested plan is kept (as with "terracanary plan --out"), so that exactly what was tested can be applied with "terracanary apply --plan".
+
 Exit Codes:
-	 0 - Success; plan succeeded with no changes
+	 0 - Success; plan succeeded with no changes (other than allowed ones)
 	15 - Plan succeeded, but had changes
 	 * - Plan failed due to terraform or other errors`,
+		Example: `terracanary test -s main:4 -i code:5 -u aws_ecs_service.default
+terracanary test -s main:4 -i code:5 --ignore-type aws_ecs_task_definition --deny-replace 'aws_ecs_service.*' --json
+terracanary test -s main:4 -u 'module.service.*' --allow-create 'aws_cloudwatch_metric_alarm.*'`,
 		Run: func(cmd *cobra.Command, args []string) {
 			stack := parseSingleStack(cmd)
 			inputStacks := parseStackArgs(cmd, unversionedInputStacks, versionedInputStacks)
 
-			updateable := make(map[string]bool)
-			for _, r := range ignoreUpdate {
-				updateable[r] = true
+			report, err := testStack(stack, inputStacks, policy, out, args)
+			if jsonReport && (err == nil || canarrors.Is(err, canarrors.PlanHasChanges)) {
+				jsn, jsonErr := json.MarshalIndent(report, "", "    ")
+				exitIf(jsonErr)
+				fmt.Println(string(jsn))
 			}
-
-			// See what would happen if we applied to existing stack
-			planBytes, err := stack.GeneratePlan(inputStacks, args...)
-			exitIf(err)
-
-			plan, err := terraform.ReadPlan(bytes.NewReader(planBytes))
 			exitIf(err)
-
-			for _, module := range plan.Diff.Modules {
-				for name, resource := range module.Resources {
-					switch resource.ChangeType() {
-					case terraform.DiffNone:
-						continue
-					case terraform.DiffUpdate:
-						if updateable[name] {
-							log.Println("Found allowed update to:", name)
-							continue
-						}
-					}
-					exitWith(canarrors.PlanHasChanges.Details("Would change: ", name))
-				}
-			}
 			log.Println("Test plan successful.")
 		},
 	}
 
-	testCmd.Flags().StringArrayVarP(&ignoreUpdate, "ignore-update", "u", []string{}, "ignore updates to named resource")
+	testCmd.Flags().StringVar(&out, "out", "", "save the tested plan to this file, to be applied later with 'apply --plan'")
+	testCmd.Flags().StringArrayVarP(&policy.IgnoreUpdate, "ignore-update", "u", []string{}, "ignore in-place updates to resources matching pattern; may repeat")
+	testCmd.Flags().BoolVar(&policy.StrictIgnoreUpdate, "strict-ignore-update", false, "only let --ignore-update patterns match full resource addresses, not resources of that name inside modules")
+	testCmd.Flags().StringArrayVar(&policy.AllowCreate, "allow-create", []string{}, "allow creation of resources matching pattern; may repeat")
+	testCmd.Flags().BoolVar(&policy.AllowRead, "allow-read", false, "allow data sources to be read during apply")
+	testCmd.Flags().StringArrayVar(&policy.IgnoreType, "ignore-type", []string{}, "ignore all changes to resources of the given type; may repeat")
+	testCmd.Flags().StringArrayVar(&policy.DenyReplace, "deny-replace", []string{}, "never allow replacement of resources matching pattern, even if otherwise ignored; may repeat")
+	testCmd.Flags().BoolVar(&jsonReport, "json", false, "output report of all changes as JSON")
 	takesSingleStack(testCmd)
 	takesInputStacks(testCmd)
 	RootCmd.AddCommand(testCmd)
@@ -9,9 +9,9 @@ import (
 	"github.com/myhelix/terracanary/stacks"
 	"github.com/spf13/cobra"
 
+	"context"
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -29,132 +29,172 @@ func init() {
 If the task runs, but provides a non-0 exit code, terracanary will pass through the task exit code; if you need to respond to specific task exit codes, make sure they don't overlap terracanary exit codes (see canarrors/errors.go).'`,
 		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			cmdWords := args
-
-			ecsSvc := ecs.New(stacks.AWSSession, &aws.Config{
-				Region: &region,
-			})
-
-			if timeout != 0 {
-				// Wait for deadline, then exit; brutal but simple
-				go func() {
-					time.Sleep(timeout)
-					canarrors.Timeout.Details("after ", timeout).Exit()
-				}()
-			}
+			canarrors.ExitIf(RunTask(aws.BackgroundContext(), region, cluster, taskDefinition, containerName, args, timeout))
+		},
+	}
+	runCmd.Flags().StringVar(&region, "region", "", "AWS region of cluster")
+	runCmd.Flags().StringVar(&cluster, "cluster", "", "Name of ECS cluster")
+	runCmd.Flags().StringVar(&taskDefinition, "task-def", "", "ECS task definition ARN")
+	runCmd.Flags().StringVar(&containerName, "container", "", "Name of container to use inside task definition")
+	runCmd.Flags().DurationVar(&timeout, "timeout", 0, "Timeout (default wait forever)")
+	runCmd.MarkFlagRequired("region")
+	runCmd.MarkFlagRequired("cluster")
+	runCmd.MarkFlagRequired("task-def")
+	ecsCmd.AddCommand(runCmd)
+}
+
+// Runs a single ECS task and waits for it to finish. If the task's container exits non-0, the returned error carries
+// the container's exit code. A timeout of 0 means wait forever; after a timeout (or once ctx is cancelled), the task
+// is left running but nothing more is polled or relayed.
+func RunTask(ctx aws.Context, region, cluster, taskDefinition, containerName string, cmdWords []string, timeout time.Duration) error {
+	return withTimeout(ctx, timeout, func(ctx aws.Context) error {
+		ecsSvc := ecs.New(stacks.AWSSession, &aws.Config{
+			Region: &region,
+		})
 
-			// Look up the task definition, to see if we can infer some config from it.
-			dtdo, err := ecsSvc.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
-				TaskDefinition: &taskDefinition,
-			})
-			canarrors.ExitIf(err)
+		// Look up the task definition, to see if we can infer some config from it.
+		dtdo, err := ecsSvc.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: &taskDefinition,
+		})
+		if err != nil {
+			return err
+		}
 
-			containers := dtdo.TaskDefinition.ContainerDefinitions
-			var container *ecs.ContainerDefinition
+		containers := dtdo.TaskDefinition.ContainerDefinitions
+		var container *ecs.ContainerDefinition
 
-			if containerName == "" {
-				// If there's only one container, we can assume it's the one you want.
-				if len(containers) != 1 {
-					canarrors.ExitWith(fmt.Errorf("Cannot infer contain name from task definition; please specify with --container. Found container definitions:\n%v", containers))
-				}
-				container = containers[0]
-				containerName = *container.Name
-			} else {
-				// Find our specified container
-				for _, c := range containers {
-					if *c.Name == containerName {
-						container = c
-						break
-					}
-				}
-				if container == nil {
-					canarrors.ExitWith(fmt.Errorf("Could not find container '%s' in task definition. Found container definitions:\n%v", containerName, containers))
+		if containerName == "" {
+			// If there's only one container, we can assume it's the one you want.
+			if len(containers) != 1 {
+				return fmt.Errorf("Cannot infer contain name from task definition; please specify with --container. Found container definitions:\n%v", containers)
+			}
+			container = containers[0]
+			containerName = *container.Name
+		} else {
+			// Find our specified container
+			for _, c := range containers {
+				if *c.Name == containerName {
+					container = c
+					break
 				}
 			}
+			if container == nil {
+				return fmt.Errorf("Could not find container '%s' in task definition. Found container definitions:\n%v", containerName, containers)
+			}
+		}
 
-			log.Println("Starting task with command: ", cmdWords)
-			count := int64(1)
-			// For future
-			// Minimum Fargate size
-			//cpu := int64(256)
-			//memory := int64(512)
-			rto, err := ecsSvc.RunTask(&ecs.RunTaskInput{
-				Count:   &count,
-				Cluster: &cluster,
-				//LaunchType: aws.String("FARGATE"),
-				TaskDefinition: &taskDefinition,
-				Overrides: &ecs.TaskOverride{ContainerOverrides: []*ecs.ContainerOverride{{
-					Name:    &containerName,
-					Command: aws.StringSlice(cmdWords),
-					//Cpu: &cpu,
-					//Memory: &memory,
-				}}},
-			})
-			canarrors.ExitIf(err)
-			if len(rto.Failures) > 0 || len(rto.Tasks) != 1 {
-				canarrors.ExitWith(fmt.Errorf("Error starting task:\n%v", rto))
+		log.Println("Starting task with command: ", cmdWords)
+		count := int64(1)
+		// For future
+		// Minimum Fargate size
+		//cpu := int64(256)
+		//memory := int64(512)
+		rto, err := ecsSvc.RunTaskWithContext(ctx, &ecs.RunTaskInput{
+			Count:   &count,
+			Cluster: &cluster,
+			//LaunchType: aws.String("FARGATE"),
+			TaskDefinition: &taskDefinition,
+			Overrides: &ecs.TaskOverride{ContainerOverrides: []*ecs.ContainerOverride{{
+				Name:    &containerName,
+				Command: aws.StringSlice(cmdWords),
+				//Cpu: &cpu,
+				//Memory: &memory,
+			}}},
+		})
+		if err != nil {
+			return err
+		}
+		if len(rto.Failures) > 0 || len(rto.Tasks) != 1 {
+			return fmt.Errorf("Error starting task:\n%v", rto)
+		}
+		task := rto.Tasks[0]
+		log.Println("Started task:", *task.TaskArn)
+
+		dti := ecs.DescribeTasksInput{
+			Cluster: &cluster,
+			Tasks:   []*string{task.TaskArn},
+		}
+		taskId := strings.Split(*task.TaskArn, "/")[1]
+		logRelayer := NewLogRelayer(container, taskId)
+
+		for {
+			err = sleep(ctx, 1*time.Second)
+			if err != nil {
+				log.Println("Stopped waiting for task:", *task.TaskArn)
+				return err
 			}
-			task := rto.Tasks[0]
-			log.Println("Started task:", *task.TaskArn)
 
-			dti := ecs.DescribeTasksInput{
-				Cluster: &cluster,
-				Tasks:   []*string{task.TaskArn},
+			// Start by relaying any new logs
+			logRelayer(ctx)
+
+			dto, err := ecsSvc.DescribeTasksWithContext(ctx, &dti)
+			if err != nil {
+				return err
 			}
-			taskId := strings.Split(*task.TaskArn, "/")[1]
-			logRelayer := NewLogRelayer(container, taskId)
-
-			for {
-				time.Sleep(1 * time.Second)
-
-				// Start by relaying any new logs
-				logRelayer()
-
-				dto, err := ecsSvc.DescribeTasks(&dti)
-				canarrors.ExitIf(err)
-				if len(dto.Failures) > 0 || len(dto.Tasks) != 1 {
-					if len(dto.Failures) == 1 && *dto.Failures[0].Reason == "MISSING" {
-						log.Println("Task not ready; waiting for it to appear.")
-						continue
-					} else {
-						canarrors.ExitWith(fmt.Errorf("Error checking on task:\n%v", rto))
-					}
+			if len(dto.Failures) > 0 || len(dto.Tasks) != 1 {
+				if len(dto.Failures) == 1 && *dto.Failures[0].Reason == "MISSING" {
+					log.Println("Task not ready; waiting for it to appear.")
+					continue
+				} else {
+					return fmt.Errorf("Error checking on task:\n%v", rto)
 				}
-				task = dto.Tasks[0]
-				if *task.LastStatus == "STOPPED" {
-					container := task.Containers[0]
-					if container.ExitCode == nil {
-						if container.Reason == nil {
-							log.Printf("Task exited: %s\n", *task.StoppedReason)
-						} else {
-							log.Printf("Task container exited: %s\n", *container.Reason)
-						}
-						os.Exit(1)
-					} else if code := *container.ExitCode; code != 0 {
-						log.Printf("Task container exited with code %d\n", code)
-						os.Exit(int(code))
+			}
+			task = dto.Tasks[0]
+			if *task.LastStatus == "STOPPED" {
+				container := task.Containers[0]
+				if container.ExitCode == nil {
+					if container.Reason == nil {
+						return TaskFailed.Details("Task exited: ", *task.StoppedReason)
 					}
-					log.Println("Task succeeded.")
-					break
+					return TaskFailed.Details("Task container exited: ", *container.Reason)
+				} else if code := *container.ExitCode; code != 0 {
+					// Pass through the task's exit code
+					return canarrors.ErrorType{ExitCode: int(code), Description: TaskFailed.Description}.Details("Task container exited with code ", code)
 				}
+				log.Println("Task succeeded.")
+				return nil
 			}
-		},
+		}
+	})
+}
+
+// Task failed without an exit code of its own
+var TaskFailed = canarrors.ErrorType{ExitCode: 1, Description: "ECS task failed"}
+
+// Runs f with a context derived from ctx that is cancelled after the timeout (0 means no limit), returning a Timeout
+// error if that's what stopped it. f must pass the context to everything that polls or waits, so that nothing is
+// left running once it returns.
+func withTimeout(ctx aws.Context, timeout time.Duration, f func(ctx aws.Context) error) error {
+	var cancel context.CancelFunc
+	if timeout == 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	err := f(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		return canarrors.Timeout.Details("after ", timeout)
+	}
+	return err
+}
+
+// Waits for the duration, returning early with the context's error if it's done first
+func sleep(ctx aws.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
 	}
-	runCmd.Flags().StringVar(&region, "region", "", "AWS region of cluster")
-	runCmd.Flags().StringVar(&cluster, "cluster", "", "Name of ECS cluster")
-	runCmd.Flags().StringVar(&taskDefinition, "task-def", "", "ECS task definition ARN")
-	runCmd.Flags().StringVar(&containerName, "container", "", "Name of container to use inside task definition")
-	runCmd.Flags().DurationVar(&timeout, "timeout", 0, "Timeout (default wait forever)")
-	runCmd.MarkFlagRequired("region")
-	runCmd.MarkFlagRequired("cluster")
-	runCmd.MarkFlagRequired("task-def")
-	ecsCmd.AddCommand(runCmd)
 }
 
-func NewLogRelayer(container *ecs.ContainerDefinition, taskId string) func() {
+// Returns a function that logs any new log events from the task's container, as found through its awslogs
+// configuration
+func NewLogRelayer(container *ecs.ContainerDefinition, taskId string) func(aws.Context) {
 	if *container.LogConfiguration.LogDriver != "awslogs" {
 		log.Println("Container not using awslogs; won't output logs.")
-		return func() {}
+		return func(aws.Context) {}
 	}
 	getOpt := func(k string) string {
 		v := container.LogConfiguration.Options[k]
@@ -170,12 +210,12 @@ func NewLogRelayer(container *ecs.ContainerDefinition, taskId string) func() {
 
 	if region == "" {
 		log.Println("Could not find awslogs region; won't output logs.")
-		return func() {}
+		return func(aws.Context) {}
 	}
 
 	if logGroup == "" {
 		log.Println("Could not find awslogs group; won't output logs.")
-		return func() {}
+		return func(aws.Context) {}
 	}
 
 	cwSvc := cloudwatchlogs.New(stacks.AWSSession, &aws.Config{
@@ -186,8 +226,8 @@ func NewLogRelayer(container *ecs.ContainerDefinition, taskId string) func() {
 	fmt.Println("Looking for logs at:", logStream)
 
 	var logsFrom int64
-	return func() {
-		resp, err := cwSvc.GetLogEvents(&cloudwatchlogs.GetLogEventsInput{
+	return func(ctx aws.Context) {
+		resp, err := cwSvc.GetLogEventsWithContext(ctx, &cloudwatchlogs.GetLogEventsInput{
 			StartFromHead: aws.Bool(true),
 			StartTime:     &logsFrom,
 			LogGroupName:  &logGroup,
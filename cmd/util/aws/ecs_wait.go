@@ -38,24 +38,7 @@ If a service is specified, wait for it to reach the expected final state based u
 			if instances == -1 && service == "" {
 				canarrors.ExitWith(fmt.Errorf("Must specify either --instances or --service."))
 			}
-			if timeout != 0 {
-				// Wait for deadline, then exit; brutal but simple
-				go func() {
-					time.Sleep(timeout)
-					canarrors.Timeout.Details("after ", timeout).Exit()
-				}()
-			}
-
-			// If you really want to, you can do both.
-
-			if instances != -1 {
-				waitForInstances(region, cluster, instances)
-			}
-
-			if service != "" {
-				waitForService(region, cluster, service)
-			}
-
+			canarrors.ExitIf(Wait(aws.BackgroundContext(), region, cluster, instances, service, timeout))
 			log.Println("Done.")
 		},
 	}
@@ -70,19 +53,41 @@ If a service is specified, wait for it to reach the expected final state based u
 	ecsCmd.AddCommand(waitCmd)
 }
 
-func waitForInstances(region, cluster string, instances int64) {
+// Waits for the cluster to have the given number of instances (unless -1), and then for the service to be stable
+// (unless ""). A timeout of 0 means wait forever; polling stops after a timeout, or once ctx is cancelled.
+func Wait(ctx aws.Context, region, cluster string, instances int64, service string, timeout time.Duration) error {
+	return withTimeout(ctx, timeout, func(ctx aws.Context) error {
+		// If you really want to, you can do both.
+
+		if instances != -1 {
+			err := waitForInstances(ctx, region, cluster, instances)
+			if err != nil {
+				return err
+			}
+		}
+
+		if service != "" {
+			return waitForService(ctx, region, cluster, service)
+		}
+		return nil
+	})
+}
+
+func waitForInstances(ctx aws.Context, region, cluster string, instances int64) error {
 	ecsSvc := ecs.New(stacks.AWSSession, &aws.Config{
 		Region: &region,
 	})
 	var lastCount int64 = -1
 	log.Printf("Waiting for instance count to be exactly %d for cluster %s", instances, cluster)
 	for {
-		dco, err := ecsSvc.DescribeClusters(&ecs.DescribeClustersInput{
+		dco, err := ecsSvc.DescribeClustersWithContext(ctx, &ecs.DescribeClustersInput{
 			Clusters: []*string{&cluster},
 		})
-		canarrors.ExitIf(err)
+		if err != nil {
+			return err
+		}
 		if len(dco.Clusters) != 1 || len(dco.Failures) > 0 {
-			canarrors.ExitWith(fmt.Errorf("Error describing cluster: %v", dco))
+			return fmt.Errorf("Error describing cluster: %v", dco)
 		}
 		count := *dco.Clusters[0].RegisteredContainerInstancesCount
 		if count != lastCount {
@@ -90,13 +95,16 @@ func waitForInstances(region, cluster string, instances int64) {
 			log.Printf("Instances: %d", count)
 		}
 		if count == instances {
-			break
+			return nil
+		}
+		err = sleep(ctx, time.Second*3)
+		if err != nil {
+			return err
 		}
-		time.Sleep(time.Second * 3)
 	}
 }
 
-func waitForService(region, cluster, service string) {
+func waitForService(ctx aws.Context, region, cluster, service string) error {
 	ecsSvc := ecs.New(stacks.AWSSession, &aws.Config{
 		Region: &region,
 	})
@@ -107,29 +115,36 @@ func waitForService(region, cluster, service string) {
 		Region: &region,
 	})
 
-	describeService := func() *ecs.Service {
-		dso, err := ecsSvc.DescribeServices(&ecs.DescribeServicesInput{
+	describeService := func() (*ecs.Service, error) {
+		dso, err := ecsSvc.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{
 			Services: []*string{&service},
 			Cluster:  &cluster,
 		})
-		canarrors.ExitIf(err)
+		if err != nil {
+			return nil, err
+		}
 		if len(dso.Services) != 1 || len(dso.Failures) > 0 {
-			canarrors.ExitWith(fmt.Errorf("Error describing service: %v", dso))
+			return nil, fmt.Errorf("Error describing service: %v", dso)
 		}
-		return dso.Services[0]
+		return dso.Services[0], nil
 	}
-	getTaskArns := func() (arns []string) {
-		tasks, err := ecsSvc.ListTasks(&ecs.ListTasksInput{
+	getTaskArns := func() (arns []string, err error) {
+		tasks, err := ecsSvc.ListTasksWithContext(ctx, &ecs.ListTasksInput{
 			Cluster: &cluster,
 		})
-		canarrors.ExitIf(err)
+		if err != nil {
+			return nil, err
+		}
 		for _, task := range tasks.TaskArns {
 			arns = append(arns, *task)
 		}
 		sort.Strings(arns)
-		return arns
+		return arns, nil
+	}
+	serv, err := describeService()
+	if err != nil {
+		return err
 	}
-	serv := describeService()
 	waitForNumber := *serv.DesiredCount
 	taskDefinition := *serv.TaskDefinition
 
@@ -140,7 +155,10 @@ func waitForService(region, cluster, service string) {
 	for {
 		var newDep *ecs.Deployment
 		var oldDepC, newDepC int64
-		serv := describeService()
+		serv, err := describeService()
+		if err != nil {
+			return err
+		}
 		for _, deployment := range serv.Deployments {
 			if *deployment.TaskDefinition == taskDefinition {
 				newDep = deployment
@@ -158,9 +176,18 @@ func waitForService(region, cluster, service string) {
 		}
 		if oldDepC == 0 && newDepC == waitForNumber {
 			// Check that our new situation is stable
-			tasks1 := getTaskArns()
-			time.Sleep(5 * time.Second)
-			tasks2 := getTaskArns()
+			tasks1, err := getTaskArns()
+			if err != nil {
+				return err
+			}
+			err = sleep(ctx, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			tasks2, err := getTaskArns()
+			if err != nil {
+				return err
+			}
 
 			// Recheck length here, in case the successful count was unstable, but we're now in a
 			// stable bad state
@@ -176,33 +203,40 @@ Second try:
 `, newDepC, tasks1, tasks2)
 		} else {
 			// No sign of success; keep waiting.
-			time.Sleep(3 * time.Second)
+			err = sleep(ctx, 3*time.Second)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// Don't think there would currently ever be more than 1, but might as well use for
 	for _, lb := range serv.LoadBalancers {
 		// Need to describe tasks to determine what instances we expect to be in service
-		dto, err := ecsSvc.DescribeTasks(&ecs.DescribeTasksInput{
+		dto, err := ecsSvc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
 			Cluster: &cluster,
 			Tasks:   aws.StringSlice(finalTaskArns),
 		})
-		canarrors.ExitIf(err)
+		if err != nil {
+			return err
+		}
 		if len(dto.Failures) > 0 {
-			canarrors.ExitWith(fmt.Errorf("Error describing tasks: %v", dto))
+			return fmt.Errorf("Error describing tasks: %v", dto)
 		}
 
 		var containerInstances []*string
 		for _, task := range dto.Tasks {
 			containerInstances = append(containerInstances, task.ContainerInstanceArn)
 		}
-		dcio, err := ecsSvc.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+		dcio, err := ecsSvc.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
 			Cluster:            &cluster,
 			ContainerInstances: containerInstances,
 		})
-		canarrors.ExitIf(err)
+		if err != nil {
+			return err
+		}
 		if len(dcio.Failures) > 0 {
-			canarrors.ExitWith(fmt.Errorf("Error describing container instances: %v", dcio))
+			return fmt.Errorf("Error describing container instances: %v", dcio)
 		}
 
 		var name *string = lb.LoadBalancerName
@@ -218,10 +252,13 @@ Second try:
 			}
 			log.Println("Targets: ", targets)
 
-			elbSvc1.WaitUntilInstanceInService(&elb.DescribeInstanceHealthInput{
+			elbSvc1.WaitUntilInstanceInServiceWithContext(ctx, &elb.DescribeInstanceHealthInput{
 				LoadBalancerName: name,
 				Instances:        targets,
 			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 		}
 
 		var tgARN *string = lb.TargetGroupArn
@@ -237,10 +274,14 @@ Second try:
 			}
 			log.Println("Targets: ", targets)
 
-			elbSvc2.WaitUntilTargetInService(&elbv2.DescribeTargetHealthInput{
+			elbSvc2.WaitUntilTargetInServiceWithContext(ctx, &elbv2.DescribeTargetHealthInput{
 				TargetGroupArn: tgARN,
 				Targets:        targets,
 			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 		}
 	}
+	return nil
 }
@@ -12,6 +12,20 @@
 # This script doesn't include doing any testing of the results of the canary deployment; it can
 # just be run in two modes by an external system/human, to either send all traffic to a new
 # code version or to split traffic between a new code version and whatever was previously running.
+# It can also be run in a third mode to roll back the routing stack to what it was before the last
+# deployment.
+#
+# "terracanary promote" re-applies the routing stack with its previous inputs, swapping in the new
+# stack for the named aliases, and records the previous inputs for "terracanary rollback". If
+# terracanary has no record of applying the routing stack (on the first deployment, or if it was
+# last applied by an older terracanary), promote simply applies it with the new stack as the named
+# aliases, so start with a "full" deployment, which names both.
+#
+# The canary flow (build, route "next", check, then promote or abort) is also built in as
+# "terracanary canary", which records its progress so that an interrupted deployment can be resumed
+# or aborted:
+#
+#   terracanary canary start --stack main --routing routing --check ./smoke_test.sh
 #
 # The specifics of where to find the new code artifacts to deploy are assumed to have been configured
 # earlier in the environment or via "terracanary args".
@@ -21,9 +35,11 @@ set -ex
 # Get currently deployed stack number
 CURRENT="main:$(terracanary output -S routing current_stack_version)" || CURRENT=""
 
-# Get next completely unused version number, and build new stack
-NEW="main:$(terracanary next)"
-terracanary apply -s $NEW
+if [[ $DEPLOY_TYPE != rollback ]]; then
+    # Get next completely unused version number, and build new stack
+    NEW="main:$(terracanary next)"
+    terracanary apply -s $NEW
+fi
 
 case $DEPLOY_TYPE in
 canary)
@@ -33,11 +49,16 @@ canary)
     fi
 
     # Apply new stack for testing
-    terracanary apply -S routing -i $CURRENT:current -i $NEW:next
+    terracanary promote --routing routing --stack $NEW --as next
     ;;
 full)
     # Apply the new stack as current and next (100% combined traffic)
-    terracanary apply -S routing -i $NEW:current -i $NEW:next
+    terracanary promote --routing routing --stack $NEW --as current --as next
+    ;;
+rollback)
+    # Undo the last promotion, restoring whatever routing had before
+    terracanary rollback --routing routing
+    exit
     ;;
 *)
     echo "Unknown DEPLOY_TYPE."
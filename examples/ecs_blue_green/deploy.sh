@@ -43,10 +43,12 @@ MAIN="main:$(terracanary output -S routing main_stack_version)" || MAIN=""
 MAIN_INPUTS="-i $CODE -I shared"
 
 # Is this a code-only update? Test if we can do a shortcut deploy.
+# The tested plan is saved, so that the shortcut deploy applies exactly what was tested.
+MAIN_PLAN=$(mktemp -d)/main.plan
 if [[ $MAIN ]]; then
     ret=0
     # Allow updates to ECS service (for code changes)
-    terracanary test -s $MAIN $MAIN_INPUTS -u aws_ecs_service.default || ret=$?
+    terracanary test -s $MAIN $MAIN_INPUTS -u aws_ecs_service.default --out $MAIN_PLAN || ret=$?
 else
     ret=15
 fi
@@ -60,7 +62,7 @@ if [[ $ret = 0 ]]; then
     deploy_check_task
 
     # Upgrade stack to new code revision
-    terracanary apply -s $MAIN $MAIN_INPUTS
+    terracanary apply -s $MAIN --plan $MAIN_PLAN
 
     # Wait for task transition to complete
     wait_for_tasks
@@ -109,7 +111,7 @@ terracanary destroy -a code $CODE_INPUTS -e $CODE -l module.task_definition.aws_
 
 # Clean up any legacy stack; for projects migrating into terracanary
 # Assumes persistent resources aside from DNS weren't previously included in project terraform
-terracanary destroy --legacy --skip-confirmation -f main/providers.tf \
+terracanary destroy --legacy --skip-confirmation --force=main/providers.tf \
                                 -l module.task_definition.aws_ecs_task_definition.default \
 			                    -l aws_route53_record.default
 
@@ -0,0 +1,121 @@
+package stacks
+
+import (
+	"strings"
+)
+
+// Reports whether a resource address (as shown by "terraform state list") matches a pattern. In patterns, '*'
+// matches any run of characters and '?' any single character; everything else is literal. A pattern also matches
+// every resource inside a module it matches (e.g. "module.task_definition"), and every instance of a resource
+// with count/for_each (e.g. "aws_instance.web" matches "aws_instance.web[2]").
+func MatchAddress(pattern, address string) bool {
+	for _, candidate := range addressCandidates(address) {
+		if globMatch(pattern, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any of the patterns match
+func MatchAnyAddress(patterns []string, address string) bool {
+	return MatchingPattern(patterns, address) != ""
+}
+
+// Returns the first pattern matching the address, or ""
+func MatchingPattern(patterns []string, address string) string {
+	for _, p := range patterns {
+		if MatchAddress(p, address) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Every string a pattern may match to select this address: the address itself, the address without its instance
+// key, and each enclosing module (with and without instance keys).
+func addressCandidates(address string) (candidates []string) {
+	candidates = append(candidates, address)
+	if stripped := stripInstanceKey(address); stripped != address {
+		candidates = append(candidates, stripped)
+	}
+	steps := splitAddress(address)
+	for i := 0; i+1 < len(steps); i += 2 {
+		if steps[i] != "module" {
+			break
+		}
+		prefix := strings.Join(steps[:i+2], ".")
+		candidates = append(candidates, prefix)
+		if stripped := stripInstanceKey(prefix); stripped != prefix {
+			candidates = append(candidates, stripped)
+		}
+	}
+	return
+}
+
+// Returns the address relative to its module, e.g. "aws_instance.web[0]" for "module.a.module.b.aws_instance.web[0]"
+func WithoutModule(address string) string {
+	steps := splitAddress(address)
+	i := 0
+	for i+2 < len(steps) && steps[i] == "module" {
+		i += 2
+	}
+	return strings.Join(steps[i:], ".")
+}
+
+func stripInstanceKey(address string) string {
+	if strings.HasSuffix(address, "]") {
+		if i := strings.LastIndex(address, "["); i > 0 {
+			return address[:i]
+		}
+	}
+	return address
+}
+
+// Splits an address on dots, ignoring dots inside instance keys like ["a.b"]
+func splitAddress(address string) (parts []string) {
+	depth := 0
+	start := 0
+	for i, c := range address {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '.':
+			if depth == 0 {
+				parts = append(parts, address[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, address[start:])
+}
+
+// Matches '*' and '?' wildcards against the whole string. Only the most recent '*' is ever backtracked to, since
+// any earlier one could only match what it already does plus what the later one would; this keeps matching
+// O(len(pattern)*len(s)) rather than exponential in the number of '*'s.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, starMatch := -1, 0 // Index in pattern of the last '*', and where in s its match ends
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, starMatch = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			// Let the last '*' match one more character, and try again from there
+			starMatch++
+			p, i = star+1, starMatch
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,120 @@
+package stacks
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"?", "", false},
+		{"?", "a", true},
+		{"?", "ab", false},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"a*c", "ac", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXcYb", false},
+		{"*a*a*a*b", "aaaaaaab", true},
+		{"*a*a*a*b", "aaaaaaac", false},
+		{"a?c*", "abcdef", true},
+		{"**", "x", true},
+		{"aws_*.web", "aws_instance.web", true},
+		{"aws_*.web", "aws_instance.web[0]", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatchManyStars(t *testing.T) {
+	pattern := strings.Repeat("*a", 30) + "*b"
+	s := strings.Repeat("a", 200)
+	start := time.Now()
+	if globMatch(pattern, s) {
+		t.Errorf("globMatch(%q, %q) = true, want false", pattern, s)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("globMatch took %s", elapsed)
+	}
+}
+
+func TestMatchAddress(t *testing.T) {
+	tests := []struct {
+		pattern string
+		address string
+		want    bool
+	}{
+		{"aws_instance.web", "aws_instance.web", true},
+		{"aws_instance.web", "aws_instance.web[2]", true},
+		{"aws_instance.web", `aws_instance.web["a.b"]`, true},
+		{"aws_instance.web", "aws_instance.webserver", false},
+		{"aws_instance.web[1]", "aws_instance.web[2]", false},
+		{"module.task_definition", "module.task_definition.aws_ecs_task_definition.default", true},
+		{"module.task_definition", "module.task_definition[0].aws_ecs_task_definition.default", true},
+		{"module.task_definition", "module.other.aws_ecs_task_definition.default", false},
+		{"module.outer", "module.outer.module.inner.aws_s3_bucket.b", true},
+		{"module.outer.module.inner", "module.outer.module.inner.aws_s3_bucket.b", true},
+		{"module.inner", "module.outer.module.inner.aws_s3_bucket.b", false},
+		{"aws_ecr_repository.*", "aws_ecr_repository.app", true},
+		{"*.aws_s3_bucket.*", "module.site.aws_s3_bucket.assets", true},
+		{"aws_s3_bucket.*", "module.site.aws_s3_bucket.assets", false},
+		{"data.aws_ami.*", "data.aws_ami.ubuntu", true},
+	}
+	for _, tt := range tests {
+		if got := MatchAddress(tt.pattern, tt.address); got != tt.want {
+			t.Errorf("MatchAddress(%q, %q) = %v, want %v", tt.pattern, tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestMatchingPattern(t *testing.T) {
+	patterns := []string{"module.a", "aws_instance.*", "*"}
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"module.a.aws_instance.x", "module.a"},
+		{"aws_instance.y[0]", "aws_instance.*"},
+		{"aws_eip.z", "*"},
+	}
+	for _, tt := range tests {
+		if got := MatchingPattern(patterns, tt.address); got != tt.want {
+			t.Errorf("MatchingPattern(%v, %q) = %q, want %q", patterns, tt.address, got, tt.want)
+		}
+	}
+	if MatchAnyAddress([]string{"module.b"}, "module.a.aws_instance.x") {
+		t.Error("MatchAnyAddress matched an unrelated module")
+	}
+}
+
+func TestWithoutModule(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"aws_instance.web[0]", "aws_instance.web[0]"},
+		{"module.a.aws_instance.web", "aws_instance.web"},
+		{`module.a["x.y"].module.b[1].data.aws_ami.ubuntu`, "data.aws_ami.ubuntu"},
+		{"module.a", "module.a"},
+	}
+	for _, tt := range tests {
+		if got := WithoutModule(tt.address); got != tt.want {
+			t.Errorf("WithoutModule(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
@@ -3,15 +3,18 @@ package stacks
 import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/myhelix/terracanary/config"
 
-	"errors"
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"sort"
+	"time"
 )
 
 var AWSSession *session.Session
@@ -24,11 +27,16 @@ func init() {
 	AWSSession = session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	}))
+	s3Service = s3.New(AWSSession)
 	cred, err := AWSSession.Config.Credentials.Get()
 	if err != nil {
-		panic(err)
+		// Don't stop things that don't need AWS (e.g. tests); instead, every S3 call fails with this error
+		credErr := fmt.Errorf("Can't get AWS credentials: %s", err)
+		s3Service.Handlers.Validate.PushFront(func(r *request.Request) {
+			r.Error = credErr
+		})
+		return
 	}
-	s3Service = s3.New(AWSSession)
 	// Set up credentials env for terraform, which doesn't understand assume-role config on dev machines
 	os.Setenv("AWS_ACCESS_KEY_ID", cred.AccessKeyID)
 	os.Setenv("AWS_SECRET_ACCESS_KEY", cred.SecretAccessKey)
@@ -38,22 +46,14 @@ func init() {
 // Returns stacks sorted by version, filtered by argument (or "" for any)
 // This may include the legacy stack, if no filter is given
 func All(subdir string) (stacks []Stack, err error) {
-	loi := &s3.ListObjectsInput{
-		Bucket: aws.String(config.Global.StateFileBucket),
-		Prefix: aws.String(config.Global.StateFileBase),
-	}
-	resp, err := s3Service.ListObjects(loi)
+	// With a delimiter, terracanary's own records (and anything else in a "directory" under the base) are
+	// collapsed into common prefixes rather than listed
+	objects, err := listObjects(config.Global.StateFileBase, "/")
 	if err != nil {
-		return nil, fmt.Errorf("Error listing bucket %s: %s", *loi.Bucket, err)
+		return nil, err
 	}
-	if *resp.IsTruncated {
-		//TODO: Handle this properly
-		return nil, errors.New("Can't handle truncated response yet in aws.AllStacks()")
-	}
-	for _, obj := range resp.Contents {
-		name := *obj.Key
-
-		stack, err := fromStateFileName(name)
+	for _, obj := range objects {
+		stack, err := fromStateFileName(*obj.Key)
 		if err != nil {
 			return nil, err
 		}
@@ -106,6 +106,19 @@ func (s Stack) Exists() (bool, error) {
 	return true, nil
 }
 
+// Returns the time the stack's state file was last written
+func (s Stack) LastModified() (time.Time, error) {
+	hoi := &s3.HeadObjectInput{
+		Bucket: aws.String(config.Global.StateFileBucket),
+		Key:    aws.String(s.stateFileName()),
+	}
+	resp, err := s3Service.HeadObject(hoi)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error calling HeadObject for '%s': %s", *hoi.Key, err)
+	}
+	return *resp.LastModified, nil
+}
+
 func (s Stack) RemoveState() error {
 	doi := &s3.DeleteObjectInput{
 		Bucket: aws.String(config.Global.StateFileBucket),
@@ -117,3 +130,83 @@ func (s Stack) RemoveState() error {
 	}
 	return nil
 }
+
+// Returns all objects with keys starting with prefix, following pagination; if delimiter is not empty, keys
+// containing it after the prefix are left out.
+func listObjects(prefix, delimiter string) (objects []*s3.Object, err error) {
+	loi := &s3.ListObjectsInput{
+		Bucket: aws.String(config.Global.StateFileBucket),
+		Prefix: aws.String(prefix),
+	}
+	if delimiter != "" {
+		loi.Delimiter = aws.String(delimiter)
+	}
+	err = s3Service.ListObjectsPages(loi, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing bucket %s: %s", *loi.Bucket, err)
+	}
+	return objects, nil
+}
+
+// Returns nil (and no error) if the object does not exist
+func getObject(key string) ([]byte, error) {
+	goi := &s3.GetObjectInput{
+		Bucket: aws.String(config.Global.StateFileBucket),
+		Key:    aws.String(key),
+	}
+	resp, err := s3Service.GetObject(goi)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error reading '%s': %s", key, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading '%s': %s", key, err)
+	}
+	return body, nil
+}
+
+func putObject(key string, body []byte) error {
+	poi := &s3.PutObjectInput{
+		Bucket: aws.String(config.Global.StateFileBucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}
+	_, err := s3Service.PutObject(poi)
+	if err != nil {
+		return fmt.Errorf("Error writing '%s': %s", key, err)
+	}
+	return nil
+}
+
+// Copies an object within the state file bucket, without downloading it
+func copyObject(from, to string) error {
+	coi := &s3.CopyObjectInput{
+		Bucket:     aws.String(config.Global.StateFileBucket),
+		CopySource: aws.String(config.Global.StateFileBucket + "/" + from),
+		Key:        aws.String(to),
+	}
+	_, err := s3Service.CopyObject(coi)
+	if err != nil {
+		return fmt.Errorf("Error copying '%s' to '%s': %s", from, to, err)
+	}
+	return nil
+}
+
+func deleteObject(key string) error {
+	doi := &s3.DeleteObjectInput{
+		Bucket: aws.String(config.Global.StateFileBucket),
+		Key:    aws.String(key),
+	}
+	_, err := s3Service.DeleteObject(doi)
+	if err != nil {
+		return fmt.Errorf("Error removing '%s': %s", key, err)
+	}
+	return nil
+}
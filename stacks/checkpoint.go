@@ -0,0 +1,146 @@
+package stacks
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+
+	"log"
+	"strings"
+	"time"
+)
+
+// Progress of a multi-step operation (pipeline, canary, destroy), recorded after each step so that rerunning the
+// operation with the same run ID can skip the steps that already finished, reusing their resolved values.
+type Checkpoint struct {
+	RunID     string
+	Operation string // What the run ID was first used for (e.g. "pipeline deploy.yaml"); can't be reused for another
+	Started   time.Time
+	Updated   time.Time
+	Completed []string          // Steps completed, in order
+	Values    map[string]string // Values resolved by completed steps, e.g. allocated versions or captured outputs
+	Next      string            // Step to carry on from, for operations whose steps don't always run in the same order
+	Finished  bool
+}
+
+// How long the checkpoints of finished runs are kept, so that rerunning them does nothing; they're pruned after that
+const FinishedRunRetention = 30 * 24 * time.Hour
+
+const checkpointRecordPrefix = "runs/"
+
+func checkpointRecord(runID string) string {
+	return checkpointRecordPrefix + runID
+}
+
+// Loads the checkpoint for the run ID, or starts a new one if nothing has been recorded yet. An empty run ID gives a
+// checkpoint that is never saved, so that operations can use checkpoints unconditionally.
+func LoadCheckpoint(runID, operation string) (*Checkpoint, error) {
+	c := &Checkpoint{
+		RunID:     runID,
+		Operation: operation,
+		Values:    make(map[string]string),
+	}
+	if runID == "" {
+		return c, nil
+	}
+	found, err := ReadRecord(checkpointRecord(runID), c)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		c.Started = time.Now().UTC()
+		return c, nil
+	}
+	if c.Operation != operation {
+		return nil, canarrors.RunMismatch.Details("run ", runID, " is for ", c.Operation, ", not ", operation)
+	}
+	if c.Values == nil {
+		c.Values = make(map[string]string)
+	}
+	log.Printf("Resuming run %s; completed steps: %v\n", runID, c.Completed)
+	return c, nil
+}
+
+// True if there is saved progress to resume
+func (c *Checkpoint) Resumed() bool {
+	return len(c.Completed) > 0 || c.Finished
+}
+
+func (c *Checkpoint) Done(step string) bool {
+	for _, s := range c.Completed {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Records that the step completed, along with any values it resolved
+func (c *Checkpoint) Complete(step string, values map[string]string) error {
+	if !c.Done(step) {
+		c.Completed = append(c.Completed, step)
+	}
+	for k, v := range values {
+		c.Values[k] = v
+	}
+	return c.save()
+}
+
+// Records that the whole operation finished, so that rerunning it does nothing (for FinishedRunRetention), and prunes
+// the checkpoints of runs that finished before that
+func (c *Checkpoint) Finish() error {
+	c.Finished = true
+	err := c.save()
+	if err != nil || c.RunID == "" {
+		return err
+	}
+	return pruneCheckpoints(time.Now().Add(-FinishedRunRetention))
+}
+
+// Removes the checkpoints of runs that finished before the cutoff; unfinished runs are kept, so that they can still
+// be resumed
+func pruneCheckpoints(cutoff time.Time) error {
+	prefix := metaPrefix() + checkpointRecordPrefix
+	objects, err := listObjects(prefix, "")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if obj.LastModified == nil || obj.LastModified.After(cutoff) {
+			continue
+		}
+		runID := strings.TrimSuffix(strings.TrimPrefix(*obj.Key, prefix), ".json")
+		var old Checkpoint
+		found, err := ReadRecord(checkpointRecord(runID), &old)
+		if err != nil {
+			return err
+		}
+		if !found || !old.finishedBefore(cutoff) {
+			continue
+		}
+		log.Printf("Pruning record of run %s, finished %s\n", runID, old.Updated.Format("2006-01-02 15:04"))
+		err = old.Remove()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Checkpoint) finishedBefore(cutoff time.Time) bool {
+	return c.Finished && !c.Updated.After(cutoff)
+}
+
+// Forgets the run entirely, so that rerunning it starts from scratch
+func (c *Checkpoint) Remove() error {
+	if c.RunID == "" {
+		return nil
+	}
+	return RemoveRecord(checkpointRecord(c.RunID))
+}
+
+func (c *Checkpoint) save() error {
+	if c.RunID == "" {
+		return nil
+	}
+	c.Updated = time.Now().UTC()
+	return WriteRecord(checkpointRecord(c.RunID), c)
+}
@@ -0,0 +1,80 @@
+package stacks
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckpointSteps(t *testing.T) {
+	// Without a run ID, nothing is saved
+	c, err := LoadCheckpoint("", "pipeline deploy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Resumed() || c.Done("apply") {
+		t.Fatalf("new checkpoint has progress: %+v", c)
+	}
+
+	steps := []struct {
+		step   string
+		values map[string]string
+	}{
+		{"next", map[string]string{"VERSION": "12"}},
+		{"apply", nil},
+		{"capture", map[string]string{"OUT": "ok", "VERSION": "13"}},
+		{"apply", map[string]string{"EXTRA": "x"}}, // Completing a step again doesn't repeat it
+	}
+	for _, s := range steps {
+		err = c.Complete(s.step, s.values)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !c.Resumed() {
+		t.Error("checkpoint with completed steps isn't resumed")
+	}
+	for _, step := range []string{"next", "apply", "capture"} {
+		if !c.Done(step) {
+			t.Errorf("step %s isn't done", step)
+		}
+	}
+	if c.Done("destroy") {
+		t.Error("step destroy is done without completing it")
+	}
+	if want := []string{"next", "apply", "capture"}; !reflect.DeepEqual(c.Completed, want) {
+		t.Errorf("completed = %v, want %v", c.Completed, want)
+	}
+	if want := map[string]string{"VERSION": "13", "OUT": "ok", "EXTRA": "x"}; !reflect.DeepEqual(c.Values, want) {
+		t.Errorf("values = %v, want %v", c.Values, want)
+	}
+	if !c.Updated.IsZero() {
+		t.Error("checkpoint without a run ID was saved")
+	}
+
+	finished := &Checkpoint{Finished: true}
+	if !finished.Resumed() {
+		t.Error("finished checkpoint without steps isn't resumed")
+	}
+}
+
+func TestCheckpointPruning(t *testing.T) {
+	cutoff := time.Now().Add(-FinishedRunRetention)
+	tests := []struct {
+		name       string
+		checkpoint Checkpoint
+		prune      bool
+	}{
+		{"finished long ago", Checkpoint{Finished: true, Updated: cutoff.Add(-time.Hour)}, true},
+		{"finished at the cutoff", Checkpoint{Finished: true, Updated: cutoff}, true},
+		{"finished recently", Checkpoint{Finished: true, Updated: cutoff.Add(time.Hour)}, false},
+		{"unfinished and old", Checkpoint{Completed: []string{"a"}, Updated: cutoff.Add(-time.Hour)}, false},
+		{"unfinished and recent", Checkpoint{Updated: time.Now()}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.checkpoint.finishedBefore(cutoff); got != tt.prune {
+			t.Errorf("%s: finishedBefore = %v, want %v", tt.name, got, tt.prune)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package stacks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Recorded in .terraform after a successful init, so that later terracanary processes can skip init if nothing
+// relevant has changed
+type initRecord struct {
+	Key              string // State file the backend was configured for
+	ArgsHash         string // Hash of the full init arguments
+	ProvidersHash    string // Hash of the provider lock files
+	ConfigHash       string // Hash of the configuration files and installed module manifest
+	TerraformVersion string
+}
+
+const initRecordFile = "terracanary-init.json"
+
+func hashStrings(strs ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strs, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Hashes the names and contents of the files, skipping any that don't exist
+func hashFiles(files []string) string {
+	var contents []string
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err == nil {
+			contents = append(contents, f, string(b))
+		}
+	}
+	return hashStrings(contents...)
+}
+
+// Hashes the provider lock files terraform keeps: .terraform.lock.hcl (terraform 0.14+) and the plugin lock.json
+// files in .terraform (terraform 0.10 to 0.13)
+func providersHash(dir string) string {
+	files := []string{filepath.Join(dir, ".terraform.lock.hcl")}
+	locks, _ := filepath.Glob(filepath.Join(dir, ".terraform", "plugins", "*", "lock.json"))
+	sort.Strings(locks)
+	files = append(files, locks...)
+
+	return hashFiles(files)
+}
+
+// Hashes the directory's configuration (*.tf and *.tf.json files), which declares the modules and providers init
+// installs, and the manifest of the modules init installed. Any change to the configuration invalidates the init,
+// which is simpler (and safer) than working out which changes affect it.
+func configHash(dir string) string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tf"))
+	jsonFiles, _ := filepath.Glob(filepath.Join(dir, "*.tf.json"))
+	files = append(files, jsonFiles...)
+	sort.Strings(files)
+	files = append(files, filepath.Join(dir, ".terraform", "modules", "modules.json"))
+
+	return hashFiles(files)
+}
+
+func currentInitRecord(dir, key string, args []string) initRecord {
+	rec := initRecord{
+		Key:           key,
+		ArgsHash:      hashStrings(args...),
+		ProvidersHash: providersHash(dir),
+		ConfigHash:    configHash(dir),
+	}
+	if v, err := InstalledTerraformVersion(); err == nil {
+		rec.TerraformVersion = v.String()
+	}
+	return rec
+}
+
+// True if the directory was initialized by terracanary with the same backend key, init arguments, provider locks,
+// configuration and terraform version, and the backend configuration hasn't been changed since
+func initUpToDate(dir, key string, args []string) bool {
+	jsn, err := ioutil.ReadFile(filepath.Join(dir, ".terraform", initRecordFile))
+	if err != nil {
+		return false
+	}
+	var recorded initRecord
+	if json.Unmarshal(jsn, &recorded) != nil {
+		return false
+	}
+	return recorded == currentInitRecord(dir, key, args) && initializedKey(dir) == key
+}
+
+func recordInit(dir, key string, args []string) error {
+	jsn, err := json.MarshalIndent(currentInitRecord(dir, key, args), "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ".terraform", initRecordFile), jsn, 0644)
+}
+
+// Returns the state file key terraform's backend configuration in the directory points at, or "" if unknown
+func initializedKey(dir string) string {
+	jsn, err := ioutil.ReadFile(filepath.Join(dir, ".terraform", "terraform.tfstate"))
+	if err != nil {
+		return ""
+	}
+	var local struct {
+		Backend struct {
+			Config struct {
+				Key string
+			}
+		}
+	}
+	if json.Unmarshal(jsn, &local) != nil {
+		return ""
+	}
+	return local.Backend.Config.Key
+}
@@ -0,0 +1,73 @@
+package stacks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitUpToDate(t *testing.T) {
+	const key = "terraform.tfstate-main-3"
+	args := []string{"-backend-config=key=" + key}
+	write := func(t *testing.T, dir, name, contents string) {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend := func(key string) string {
+		return `{"backend": {"type": "s3", "config": {"key": "` + key + `"}}}`
+	}
+
+	tests := []struct {
+		name     string
+		change   func(t *testing.T, dir string)
+		args     []string
+		key      string
+		upToDate bool
+	}{
+		{"unchanged", nil, args, key, true},
+		{"unrelated file", func(t *testing.T, dir string) { write(t, dir, "README.md", "docs") }, args, key, true},
+		{"config changed", func(t *testing.T, dir string) { write(t, dir, "main.tf", `module "b" {}`) }, args, key, false},
+		{"config added", func(t *testing.T, dir string) { write(t, dir, "extra.tf.json", "{}") }, args, key, false},
+		{"config removed", func(t *testing.T, dir string) { os.Remove(filepath.Join(dir, "main.tf")) }, args, key, false},
+		{"modules reinstalled", func(t *testing.T, dir string) {
+			write(t, dir, ".terraform/modules/modules.json", `{"Modules": [{"Key": "b"}]}`)
+		}, args, key, false},
+		{"provider lock changed", func(t *testing.T, dir string) { write(t, dir, ".terraform.lock.hcl", "v2") }, args, key, false},
+		{"backend reconfigured", func(t *testing.T, dir string) {
+			write(t, dir, ".terraform/terraform.tfstate", backend("terraform.tfstate-main-4"))
+		}, args, key, false},
+		{"other arguments", nil, []string{"-upgrade"}, key, false},
+		{"other key", nil, args, "terraform.tfstate-main-4", false},
+		{"record missing", func(t *testing.T, dir string) { os.Remove(filepath.Join(dir, ".terraform", initRecordFile)) }, args, key, false},
+		{"record corrupt", func(t *testing.T, dir string) { write(t, dir, ".terraform/"+initRecordFile, "{") }, args, key, false},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "terracanary-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, dir, "main.tf", `module "a" {}`)
+		write(t, dir, ".terraform.lock.hcl", "v1")
+		write(t, dir, ".terraform/modules/modules.json", `{"Modules": [{"Key": "a"}]}`)
+		write(t, dir, ".terraform/terraform.tfstate", backend(key))
+		err = recordInit(dir, key, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.change != nil {
+			tt.change(t, dir)
+		}
+		if got := initUpToDate(dir, tt.key, tt.args); got != tt.upToDate {
+			t.Errorf("%s: initUpToDate = %v, want %v", tt.name, got, tt.upToDate)
+		}
+		os.RemoveAll(dir)
+	}
+}
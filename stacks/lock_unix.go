@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package stacks
+
+import (
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive advisory lock on the file if nobody else holds it
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
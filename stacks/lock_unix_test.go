@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package stacks
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockDirTimesOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracanary-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Another open file holds the lock, as another process would
+	f, err := os.OpenFile(filepath.Join(dir, "terracanary.lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	locked, err := tryLock(f)
+	if err != nil || !locked {
+		t.Fatalf("tryLock = %v, %v", locked, err)
+	}
+
+	err = lockDir(dir, 0)
+	if !canarrors.Is(err, canarrors.Timeout) {
+		t.Errorf("got %v, want a Timeout error", err)
+	}
+}
@@ -0,0 +1,10 @@
+package stacks
+
+import (
+	"os"
+)
+
+// Advisory locks aren't supported on Windows; use --isolated to avoid interference between processes
+func tryLock(f *os.File) (bool, error) {
+	return true, nil
+}
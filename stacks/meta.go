@@ -0,0 +1,278 @@
+package stacks
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/config"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+)
+
+// Terracanary keeps its own records about stacks in the state file bucket, under a prefix that can never be
+// mistaken for a state file name.
+func metaPrefix() string {
+	return config.Global.StateFileBase + ".terracanary/"
+}
+
+type Metadata struct {
+	Created             time.Time    // First time terracanary applied this stack
+	LastApply           *ApplyRecord `json:",omitempty"`
+	LastSuccessfulApply *ApplyRecord `json:",omitempty"` // Same as LastApply, unless that failed
+	Promotions          []Promotion  `json:",omitempty"` // Oldest first; rollbacks remove the most recent
+	Expires             *time.Time   `json:",omitempty"` // Set by "apply --ttl" for temporary stacks
+	Protected           *Protection  `json:",omitempty"` // Set by "terracanary protect"
+}
+
+// Records that the stack mustn't be destroyed or moved without explicitly overriding the protection
+type Protection struct {
+	Time   time.Time
+	Reason string `json:",omitempty"`
+}
+
+type ApplyRecord struct {
+	Time    time.Time
+	Success bool
+	Inputs  []Stack
+	Args    []string
+}
+
+// Records a change of input stacks made by "terracanary promote", so that it can be rolled back
+type Promotion struct {
+	Time     time.Time
+	From     []Stack
+	To       []Stack
+	FromArgs []string // Arguments the stack was applied with before the promotion
+	Args     []string
+	Pending  bool `json:",omitempty"` // Recorded before applying; still set if the apply failed or was interrupted
+}
+
+// Reads a named record (any JSON-serializable value) kept by terracanary in the state file bucket; returns false if
+// there is no such record.
+func ReadRecord(name string, v interface{}) (bool, error) {
+	jsn, err := getObject(recordKey(name))
+	if err != nil || jsn == nil {
+		return false, err
+	}
+	err = json.Unmarshal(jsn, v)
+	if err != nil {
+		return false, fmt.Errorf("Error parsing record %s: %s", name, err)
+	}
+	return true, nil
+}
+
+func WriteRecord(name string, v interface{}) error {
+	jsn, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	return putObject(recordKey(name), jsn)
+}
+
+func RemoveRecord(name string) error {
+	return deleteObject(recordKey(name))
+}
+
+func recordKey(name string) string {
+	return metaPrefix() + name + ".json"
+}
+
+func (s Stack) metadataRecord() string {
+	return "stacks/" + s.String()
+}
+
+// Returns empty metadata if nothing has been recorded for this stack
+func (s Stack) Metadata() (meta Metadata, err error) {
+	_, err = ReadRecord(s.metadataRecord(), &meta)
+	return
+}
+
+func (s Stack) WriteMetadata(meta Metadata) error {
+	return WriteRecord(s.metadataRecord(), meta)
+}
+
+func (s Stack) RemoveMetadata() error {
+	return RemoveRecord(s.metadataRecord())
+}
+
+func (s Stack) recordApply(inputStacks []Stack, args []string, success bool) error {
+	if !success {
+		// Don't leave records behind for stacks that never got as far as having state
+		exists, err := s.Exists()
+		if err != nil || !exists {
+			return err
+		}
+	}
+	meta, err := s.Metadata()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if meta.Created.IsZero() {
+		meta.Created = now
+	}
+	meta.LastApply = &ApplyRecord{
+		Time:    now,
+		Success: success,
+		Inputs:  inputStacks,
+		Args:    args,
+	}
+	if success {
+		meta.LastSuccessfulApply = meta.LastApply
+	}
+	err = s.WriteMetadata(meta)
+	if err != nil || !success {
+		return err
+	}
+	return s.archiveProviderConfig()
+}
+
+// Records that the stack should be destroyed by "gc --expired" once the TTL has passed; replaces any earlier
+// expiry. Does nothing if the stack doesn't exist.
+func (s Stack) SetExpiry(ttl time.Duration) error {
+	exists, err := s.Exists()
+	if err != nil || !exists {
+		return err
+	}
+	meta, err := s.Metadata()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().UTC().Add(ttl)
+	meta.Expires = &expires
+	if meta.Created.IsZero() {
+		meta.Created = time.Now().UTC()
+	}
+	return s.WriteMetadata(meta)
+}
+
+// Protects the stack against being destroyed or moved, replacing any earlier protection
+func (s Stack) Protect(reason string) error {
+	exists, err := s.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return canarrors.NoSuchStack.Details(s)
+	}
+	meta, err := s.Metadata()
+	if err != nil {
+		return err
+	}
+	meta.Protected = &Protection{
+		Time:   time.Now().UTC(),
+		Reason: reason,
+	}
+	return s.WriteMetadata(meta)
+}
+
+// Removes any protection from the stack
+func (s Stack) Unprotect() error {
+	meta, err := s.Metadata()
+	if err != nil || meta.Protected == nil {
+		return err
+	}
+	meta.Protected = nil
+	return s.WriteMetadata(meta)
+}
+
+func (m Metadata) Expired() bool {
+	return m.Expires != nil && time.Now().After(*m.Expires)
+}
+
+// Input stacks of the last apply and, if that failed (so may have only partly switched inputs), of the last apply
+// that succeeded
+func (m Metadata) Inputs() (inputs []Stack) {
+	for _, apply := range []*ApplyRecord{m.LastApply, m.LastSuccessfulApply} {
+		if apply == nil {
+			continue
+		}
+		for _, i := range apply.Inputs {
+			duplicate := false
+			for _, seen := range inputs {
+				duplicate = duplicate || seen == i
+			}
+			if !duplicate {
+				inputs = append(inputs, i)
+			}
+		}
+	}
+	return
+}
+
+// True if the stack's last apply, or its last successful apply, had the given stack as one of its inputs
+func (m Metadata) HasInput(input Stack) bool {
+	for _, i := range m.Inputs() {
+		if i.Subdir == input.Subdir && i.Version == input.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies the stack with a new set of inputs, recording the change so that it can be undone by Rollback. The
+// promotion is recorded as pending before applying, so that it can still be rolled back if the apply fails part way.
+func (s Stack) Promote(from, to []Stack, fromArgs []string, args ...string) error {
+	meta, err := s.Metadata()
+	if err != nil {
+		return err
+	}
+	meta.Promotions = append(meta.Promotions, Promotion{
+		Time:     time.Now().UTC(),
+		From:     from,
+		To:       to,
+		FromArgs: fromArgs,
+		Args:     args,
+		Pending:  true,
+	})
+	err = s.WriteMetadata(meta)
+	if err != nil {
+		return err
+	}
+
+	err = s.Apply(to, args...)
+	if err != nil {
+		return err
+	}
+	// Re-read, since applying updated the metadata
+	meta, err = s.Metadata()
+	if err != nil {
+		return err
+	}
+	if n := len(meta.Promotions); n > 0 {
+		meta.Promotions[n-1].Pending = false
+	}
+	return s.WriteMetadata(meta)
+}
+
+// Re-applies the stack with the inputs it had before its most recent promotion, and forgets that promotion
+func (s Stack) Rollback() (Promotion, error) {
+	meta, err := s.Metadata()
+	if err != nil {
+		return Promotion{}, err
+	}
+	if len(meta.Promotions) == 0 {
+		return Promotion{}, canarrors.NoHistory.Details("no recorded promotions of ", s, " to roll back")
+	}
+	last := meta.Promotions[len(meta.Promotions)-1]
+	if last.Pending {
+		log.Println("WARNING: last promotion didn't finish applying; rolling it back anyway")
+	} else if meta.LastApply != nil && !reflect.DeepEqual(meta.LastApply.Inputs, last.To) {
+		log.Println("WARNING: stack was applied with different inputs since last promotion:", meta.LastApply.Inputs)
+	}
+	log.Println("Rolling back", s, "from inputs", last.To, "to", last.From)
+
+	err = s.Apply(last.From, last.FromArgs...)
+	if err != nil {
+		return last, err
+	}
+	// Re-read, since applying updated the metadata
+	meta, err = s.Metadata()
+	if err != nil {
+		return last, err
+	}
+	meta.Promotions = meta.Promotions[:len(meta.Promotions)-1]
+	return last, s.WriteMetadata(meta)
+}
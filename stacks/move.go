@@ -0,0 +1,123 @@
+package stacks
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Gives the stack's state (and terracanary's records about it) a new identity, e.g. to rename a stack or to start
+// versioning an unversioned one. The state file is copied to its new key, and the copy is checked through terraform
+// to have the same resources before the original is removed. Nothing is applied or destroyed. The destination must
+// not already exist.
+func (s Stack) MoveTo(dest Stack) error {
+	if s.legacy || dest.legacy {
+		return canarrors.InvalidStack.Details("Can't move the legacy stack; see \"terracanary migrate-legacy\"")
+	}
+	if s.stateFileName() == dest.stateFileName() {
+		return canarrors.InvalidStack.Details("Can't move ", s, " to itself")
+	}
+	for _, stack := range []Stack{s, dest} {
+		err := stack.lock()
+		if err != nil {
+			return err
+		}
+	}
+
+	exists, err := s.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return canarrors.NoSuchStack.Details(s)
+	}
+	exists, err = dest.Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return canarrors.OddStackSelection.Details(dest, " already exists")
+	}
+
+	state, err := s.readState()
+	if err != nil {
+		return err
+	}
+	var expected []string
+	for _, r := range state.Resources {
+		expected = append(expected, r.Address)
+	}
+	sort.Strings(expected)
+
+	log.Printf("Copying state of %s to %s\n", s, dest)
+	err = copyObject(s.stateFileName(), dest.stateFileName())
+	if err != nil {
+		return err
+	}
+
+	// Check terraform sees the same thing at the new key
+	backendDir, cleanup, err := backendOnlyDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	out, err := dest.backendStateCmd(backendDir, "list")
+	if err != nil {
+		return err
+	}
+	actual := strings.Fields(out)
+	sort.Strings(actual)
+	if len(actual) != 0 || len(expected) != 0 {
+		if !reflect.DeepEqual(actual, expected) {
+			return canarrors.StateChanged.Details("copy of ", s, " at ", dest, " has resources ", actual, "; expected ", expected,
+				" (both copies have been kept)")
+		}
+	}
+
+	// Make sure nothing changed the original while we were copying it
+	err = s.checkSerial(state.Serial)
+	if err != nil {
+		log.Println("Both copies of the state have been kept.")
+		return err
+	}
+
+	var meta Metadata
+	found, err := ReadRecord(s.metadataRecord(), &meta)
+	if err != nil {
+		return err
+	}
+	if found {
+		err = dest.WriteMetadata(meta)
+		if err != nil {
+			return err
+		}
+		err = s.RemoveMetadata()
+		if err != nil {
+			return err
+		}
+	}
+	var archived ArchivedConfig
+	found, err = ReadRecord(s.configRecord(), &archived)
+	if err != nil {
+		return err
+	}
+	if found {
+		err = WriteRecord(dest.configRecord(), archived)
+		if err != nil {
+			return err
+		}
+		err = RemoveRecord(s.configRecord())
+		if err != nil {
+			return err
+		}
+	}
+	err = s.RemoveState()
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved %s to %s (%d resources).\n", s, dest, len(expected))
+	return nil
+}
@@ -0,0 +1,303 @@
+package stacks
+
+import (
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/myhelix/terracanary/canarrors"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ChangeAction string
+
+const (
+	Create  ChangeAction = "create"
+	Read    ChangeAction = "read" // Data source to be read during apply
+	Update  ChangeAction = "update"
+	Replace ChangeAction = "replace"
+	Delete  ChangeAction = "delete"
+)
+
+// A change to a single resource in a plan
+type ResourceChange struct {
+	Address string
+	Type    string
+	Action  ChangeAction
+}
+
+// Plans the stack and decodes the changes terraform would make. If savePath is given, the plan is kept there (as
+// with SavePlan); otherwise it's discarded.
+func (s Stack) PlannedChanges(savePath string, inputStacks []Stack, additionalArgs ...string) ([]ResourceChange, error) {
+	path := savePath
+	if path == "" {
+		f, err := ioutil.TempFile("", "terracanary-plan")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+		path = f.Name()
+
+		_, err = s.writePlan(path, inputStacks, additionalArgs...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, err := s.SavePlan(path, inputStacks, additionalArgs...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.PlanFileChanges(path)
+}
+
+// Decodes the changes in a plan file made for this stack; unchanged resources are omitted. Plans from terraform
+// 0.12 and later are decoded by "terraform show -json"; older ones are read directly.
+func (s Stack) PlanFileChanges(planFile string) (changes []ResourceChange, err error) {
+	path, err := filepath.Abs(planFile)
+	if err != nil {
+		return
+	}
+	version, err := InstalledTerraformVersion()
+	if err != nil {
+		return
+	}
+	if version.AtLeast(0, 12) {
+		var out string
+		out, err = s.CmdOutput("show", "-json", path)
+		if err != nil {
+			return
+		}
+		changes, err = jsonPlanChanges([]byte(out))
+	} else {
+		var plan []byte
+		plan, err = ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+		changes, err = legacyPlanChanges(plan)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding plan for %s (terraform %s): %s", s, version, err)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Address < changes[j].Address
+	})
+	return
+}
+
+type jsonPlan struct {
+	ResourceChanges []struct {
+		Address string
+		Mode    string
+		Type    string
+		Change  struct {
+			Actions []string
+		}
+	} `json:"resource_changes"`
+}
+
+func jsonPlanChanges(raw []byte) (changes []ResourceChange, err error) {
+	var p jsonPlan
+	err = json.Unmarshal(raw, &p)
+	if err != nil {
+		return
+	}
+	for _, rc := range p.ResourceChanges {
+		change := ResourceChange{
+			Address: rc.Address,
+			Type:    rc.Type,
+		}
+		switch strings.Join(rc.Change.Actions, ",") {
+		case "no-op":
+			continue
+		case "create":
+			change.Action = Create
+		case "read":
+			change.Action = Read
+		case "update":
+			change.Action = Update
+		case "delete,create", "create,delete":
+			change.Action = Replace
+		case "delete":
+			change.Action = Delete
+		default:
+			return nil, fmt.Errorf("Unexpected actions %v for %s", rc.Change.Actions, rc.Address)
+		}
+		changes = append(changes, change)
+	}
+	return
+}
+
+// Plan files from terraform before 0.12 can be decoded by the terraform package we vendor
+func legacyPlanChanges(plan []byte) ([]ResourceChange, error) {
+	p, err := terraform.ReadPlan(bytes.NewReader(plan))
+	if err != nil {
+		return nil, err
+	}
+	var changes []ResourceChange
+	for _, module := range p.Diff.Modules {
+		var prefix string
+		if len(module.Path) > 1 {
+			for _, name := range module.Path[1:] {
+				prefix += "module." + name + "."
+			}
+		}
+		for key, resource := range module.Resources {
+			parts := strings.Split(key, ".")
+			change := ResourceChange{
+				Address: prefix + v3ResourceAddress(key),
+				Type:    parts[0],
+			}
+			if parts[0] == "data" {
+				change.Type = parts[1]
+			}
+			switch resource.ChangeType() {
+			case terraform.DiffNone:
+				continue
+			case terraform.DiffCreate:
+				change.Action = Create
+				if parts[0] == "data" {
+					change.Action = Read
+				}
+			case terraform.DiffUpdate:
+				change.Action = Update
+			case terraform.DiffDestroyCreate:
+				change.Action = Replace
+			case terraform.DiffDestroy:
+				change.Action = Delete
+			case terraform.DiffRefresh:
+				change.Action = Read
+			default:
+				return nil, fmt.Errorf("Unexpected change type %v for %s", resource.ChangeType(), change.Address)
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// Saved alongside a plan file, so that the plan can later be applied to the stack it was made for
+type PlanRecord struct {
+	Stack   Stack
+	Inputs  []Stack
+	Args    []string
+	Created time.Time
+	SHA256  string // Of the plan file, so that a plan that has been replaced or changed isn't applied
+}
+
+func planRecordFile(planFile string) string {
+	return planFile + ".json"
+}
+
+// Runs plan, keeping the plan file at the given path (with a record of what it was planned for) so that it can be
+// applied later with ApplyPlan.
+func (s Stack) SavePlan(path string, inputStacks []Stack, additionalArgs ...string) (plan []byte, err error) {
+	// Terraform runs in the stack's directory
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	record := PlanRecord{
+		Stack:   s,
+		Inputs:  inputStacks,
+		Args:    append([]string{}, additionalArgs...),
+		Created: time.Now().UTC(),
+	}
+	plan, err = s.writePlan(path, inputStacks, additionalArgs...)
+	if err != nil {
+		return
+	}
+	err = writePlanRecord(path, record)
+	return
+}
+
+// Writes the record for the plan file at path, with the plan file's checksum
+func writePlanRecord(path string, record PlanRecord) (err error) {
+	record.SHA256, err = fileSHA256(path)
+	if err != nil {
+		return
+	}
+	jsn, err := json.MarshalIndent(record, "", "    ")
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(planRecordFile(path), jsn, 0644)
+}
+
+func fileSHA256(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func ReadPlanRecord(planFile string) (record PlanRecord, err error) {
+	jsn, err := ioutil.ReadFile(planRecordFile(planFile))
+	if err != nil {
+		err = fmt.Errorf("Can't find record of what plan '%s' was made for: %s", planFile, err)
+		return
+	}
+	err = json.Unmarshal(jsn, &record)
+	return
+}
+
+// Reads the record for the plan file at path, checking that the plan was made for this stack and hasn't changed since
+func (s Stack) checkPlanRecord(path string) (record PlanRecord, err error) {
+	record, err = ReadPlanRecord(path)
+	if err != nil {
+		return
+	}
+	if record.Stack.Subdir != s.Subdir || record.Stack.Version != s.Version {
+		err = canarrors.PlanMismatch.Details("plan is for ", record.Stack, ", not ", s)
+		return
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return
+	}
+	if sum != record.SHA256 {
+		err = canarrors.PlanMismatch.Details("plan file ", path, " has changed since it was saved")
+	}
+	return
+}
+
+// Applies exactly the plan previously saved by SavePlan; fails if it was planned for a different stack
+func (s Stack) ApplyPlan(planFile string) error {
+	path, err := filepath.Abs(planFile)
+	if err != nil {
+		return err
+	}
+	record, err := s.checkPlanRecord(path)
+	if err != nil {
+		return err
+	}
+	log.Println("Applying plan for", s, "made at", record.Created, "with inputs", record.Inputs)
+
+	// Variables are already baked into the plan, so configured apply args aren't used
+	cmd := Command{
+		Stack:            s,
+		Action:           "apply",
+		Args:             []string{path},
+		Init:             true,
+		OutputSeparators: true,
+	}
+	err = cmd.Run()
+	recordErr := s.recordApply(record.Inputs, record.Args, err == nil)
+	if err != nil {
+		return err
+	}
+	return recordErr
+}
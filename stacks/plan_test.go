@@ -0,0 +1,81 @@
+package stacks
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "terracanary-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	main3 := New("main", 3)
+	tests := []struct {
+		name   string
+		stack  Stack
+		change []byte // New plan file contents after saving, if any
+		ok     bool
+	}{
+		{"unchanged", main3, nil, true},
+		{"other stack", New("main", 4), nil, false},
+		{"other subdir", New("code", 3), nil, false},
+		{"plan file changed", main3, []byte("tampered"), false},
+		{"plan file rewritten identically", main3, []byte("plan"), true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "plan")
+		err := ioutil.WriteFile(path, []byte("plan"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := PlanRecord{
+			Stack:   main3,
+			Inputs:  []Stack{{Subdir: "code", Version: 5, InputAlias: "next"}},
+			Args:    []string{"-var", "x=1"},
+			Created: time.Now().UTC().Truncate(time.Second),
+		}
+		err = writePlanRecord(path, saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.change != nil {
+			err = ioutil.WriteFile(path, tt.change, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		record, err := tt.stack.checkPlanRecord(path)
+		if !tt.ok {
+			if !canarrors.Is(err, canarrors.PlanMismatch) {
+				t.Errorf("%s: got %v, want a PlanMismatch error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if record.SHA256 == "" {
+			t.Errorf("%s: no checksum recorded", tt.name)
+		}
+		record.SHA256 = ""
+		if !reflect.DeepEqual(record, saved) {
+			t.Errorf("%s: read %+v, want %+v", tt.name, record, saved)
+		}
+	}
+}
+
+func TestPlanRecordMissing(t *testing.T) {
+	if _, err := New("main", 3).checkPlanRecord(filepath.Join(os.TempDir(), "no-such-terracanary-plan")); err == nil {
+		t.Error("checkPlanRecord succeeded without a record")
+	}
+}
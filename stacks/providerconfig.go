@@ -0,0 +1,253 @@
+package stacks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Top-level blocks needed to run terraform against a stack's state without the rest of its configuration: providers
+// (so that resources can actually be destroyed), the backend, and variable declarations (which providers may use,
+// and which terracanary's -var arguments require).
+var providerConfigBlocks = map[string]bool{
+	"provider":  true,
+	"terraform": true,
+	"variable":  true,
+}
+
+// Extracts the provider, terraform and variable blocks from the .tf files in a directory
+func ExtractProviderConfig(dir string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var blocks []string
+	for _, f := range files {
+		src, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		found, err := extractBlocks(string(src), providerConfigBlocks)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", f, err)
+		}
+		blocks = append(blocks, found...)
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("No provider configuration found in %s", dir)
+	}
+	return []byte(strings.Join(blocks, "\n\n") + "\n"), nil
+}
+
+// Configuration extracted by ExtractProviderConfig when the stack was last applied
+type ArchivedConfig struct {
+	Time   time.Time
+	Config string
+}
+
+func (s Stack) configRecord() string {
+	return "config/" + s.String()
+}
+
+// Returns the provider configuration archived when the stack was last applied, or nil if there is none
+func (s Stack) ArchivedProviderConfig() ([]byte, error) {
+	var archived ArchivedConfig
+	found, err := ReadRecord(s.configRecord(), &archived)
+	if err != nil || !found {
+		return nil, err
+	}
+	return []byte(archived.Config), nil
+}
+
+// Archives the provider configuration the stack is being applied with, so that it can still be destroyed with a bare
+// "--force" after its configuration has changed or gone away. Failure to extract the configuration is only logged.
+func (s Stack) archiveProviderConfig() error {
+	dir := s.WorkingDirectory
+	if dir == "" {
+		dir = s.Subdir
+	}
+	config, err := ExtractProviderConfig(dir)
+	if err != nil {
+		log.Printf("Not archiving provider configuration for %s: %s\n", s, err)
+		return nil
+	}
+	return WriteRecord(s.configRecord(), ArchivedConfig{
+		Time:   time.Now().UTC(),
+		Config: string(config),
+	})
+}
+
+// Returns the text of each top-level block of one of the given types (e.g. 'provider "aws" { ... }') in HCL source,
+// without interpreting anything inside them.
+func extractBlocks(src string, types map[string]bool) (blocks []string, err error) {
+	i := 0
+	for {
+		i = skipSpaceAndComments(src, i)
+		if i >= len(src) {
+			return
+		}
+		start := i
+		for i < len(src) && isIdentChar(src[i]) {
+			i++
+		}
+		blockType := src[start:i]
+
+		// Labels, up to the opening brace
+		for {
+			i = skipSpaceAndComments(src, i)
+			if i >= len(src) {
+				return nil, fmt.Errorf("Unexpected end of file in %s block", blockType)
+			}
+			if src[i] == '{' || src[i] == '=' {
+				break
+			}
+			if src[i] == '"' {
+				i, err = skipString(src, i)
+				if err != nil {
+					return nil, err
+				}
+			} else if isIdentChar(src[i]) {
+				for i < len(src) && isIdentChar(src[i]) {
+					i++
+				}
+			} else {
+				return nil, fmt.Errorf("Unexpected '%c' after %s", src[i], blockType)
+			}
+		}
+		if src[i] != '{' {
+			return nil, fmt.Errorf("Expected block after %s", blockType)
+		}
+		i, err = skipBraces(src, i)
+		if err != nil {
+			return nil, err
+		}
+		if types[blockType] {
+			blocks = append(blocks, src[start:i])
+		}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Skips whitespace and comments
+func skipSpaceAndComments(src string, i int) int {
+	for i < len(src) {
+		switch {
+		case src[i] == ' ' || src[i] == '\t' || src[i] == '\r' || src[i] == '\n':
+			i++
+		case src[i] == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return len(src)
+			}
+			i += end + 4
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// Given the index of an opening brace, returns the index just after the matching closing brace, skipping over
+// strings, comments and heredocs.
+func skipBraces(src string, i int) (int, error) {
+	depth := 0
+	var err error
+	for i < len(src) {
+		switch {
+		case src[i] == '{':
+			depth++
+			i++
+		case src[i] == '}':
+			depth--
+			i++
+			if depth == 0 {
+				return i, nil
+			}
+		case src[i] == '"':
+			i, err = skipString(src, i)
+			if err != nil {
+				return 0, err
+			}
+		case src[i] == '#' || strings.HasPrefix(src[i:], "//") || strings.HasPrefix(src[i:], "/*"):
+			i = skipSpaceAndComments(src, i)
+		case strings.HasPrefix(src[i:], "<<"):
+			i, err = skipHeredoc(src, i)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			i++
+		}
+	}
+	return 0, fmt.Errorf("Unbalanced braces")
+}
+
+// Given the index of an opening quote, returns the index just after the closing one. Interpolations (which may
+// contain strings of their own) are skipped as a whole.
+func skipString(src string, i int) (int, error) {
+	var err error
+	i++
+	for i < len(src) {
+		switch {
+		case src[i] == '\\':
+			i += 2
+		case src[i] == '"':
+			return i + 1, nil
+		case strings.HasPrefix(src[i:], "${") || strings.HasPrefix(src[i:], "%{"):
+			i, err = skipBraces(src, i+1)
+			if err != nil {
+				return 0, err
+			}
+		case src[i] == '\n':
+			return 0, fmt.Errorf("Unterminated string")
+		default:
+			i++
+		}
+	}
+	return 0, fmt.Errorf("Unterminated string")
+}
+
+// Given the index of "<<" starting a heredoc ("<<EOF" or "<<-EOF"), returns the index just after its closing line
+func skipHeredoc(src string, i int) (int, error) {
+	i += 2
+	if i < len(src) && src[i] == '-' {
+		i++
+	}
+	start := i
+	for i < len(src) && isIdentChar(src[i]) {
+		i++
+	}
+	marker := src[start:i]
+	if marker == "" {
+		// Not actually a heredoc
+		return i, nil
+	}
+	for {
+		nl := strings.IndexByte(src[i:], '\n')
+		if nl < 0 {
+			return 0, fmt.Errorf("Unterminated heredoc %s", marker)
+		}
+		i += nl + 1
+		end := strings.IndexByte(src[i:], '\n')
+		line := src[i:]
+		if end >= 0 {
+			line = src[i : i+end]
+		}
+		if strings.TrimSpace(line) == marker {
+			return i + len(line), nil
+		}
+	}
+}
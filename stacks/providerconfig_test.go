@@ -0,0 +1,102 @@
+package stacks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractBlocks(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "selected types only",
+			src: `provider "aws" {
+  region = "us-east-1"
+}
+
+resource "aws_instance" "web" {
+  ami = "ami-1"
+}
+
+variable "env" {}
+`,
+			want: []string{"provider \"aws\" {\n  region = \"us-east-1\"\n}", `variable "env" {}`},
+		},
+		{
+			name: "comments",
+			src: `# provider "commented" {}
+// resource "x" "y" {}
+/* terraform {
+} */
+terraform {
+  backend "s3" {} # trailing }
+}
+`,
+			want: []string{"terraform {\n  backend \"s3\" {} # trailing }\n}"},
+		},
+		{
+			name: "braces in strings and interpolations",
+			src: `resource "null_resource" "x" {
+  triggers = { a = "}" }
+}
+provider "aws" {
+  alias = "${lookup(var.m, "}")}"
+}
+`,
+			want: []string{"provider \"aws\" {\n  alias = \"${lookup(var.m, \"}\")}\"\n}"},
+		},
+		{
+			name: "heredocs",
+			src: `resource "aws_iam_policy" "p" {
+  policy = <<EOF
+{ "unbalanced": "{"
+EOF
+}
+variable "v" {
+  default = <<-DOC
+    }
+    DOC
+}
+`,
+			want: []string{"variable \"v\" {\n  default = <<-DOC\n    }\n    DOC\n}"},
+		},
+		{
+			name: "unquoted labels",
+			src:  `provider aws { region = "eu-west-1" }`,
+			want: []string{`provider aws { region = "eu-west-1" }`},
+		},
+		{
+			name: "nothing",
+			src:  "\n# only a comment\n",
+		},
+	}
+	for _, tt := range tests {
+		got, err := extractBlocks(tt.src, providerConfigBlocks)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: extractBlocks = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtractBlocksErrors(t *testing.T) {
+	for _, src := range []string{
+		`provider "aws" {`,
+		`provider "aws"`,
+		`provider "aws {}`,
+		`region = "us-east-1"`,
+		`resource "x" "y" { policy = <<EOF
+never ends
+}`,
+	} {
+		if _, err := extractBlocks(src, providerConfigBlocks); err == nil {
+			t.Errorf("extractBlocks(%q) succeeded; want an error", src)
+		}
+	}
+}
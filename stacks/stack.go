@@ -7,9 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var Legacy = Stack{legacy: true}
@@ -17,8 +17,8 @@ var Legacy = Stack{legacy: true}
 type Stack struct {
 	Subdir           string
 	Version          uint
-	InputAlias       string // Used for input stacks to provide alternate input variable prefix
-	WorkingDirectory string // Override normal working directory for Subdir
+	InputAlias       string `json:",omitempty"` // Used for input stacks to provide alternate input variable prefix
+	WorkingDirectory string `json:"-"`          // Override normal working directory for Subdir
 	legacy           bool   // Is this the legacy stack?
 }
 
@@ -45,6 +45,26 @@ func Parse(subdir, vs string) (Stack, error) {
 	return New(subdir, uint(version)), nil
 }
 
+// Parses a stack as given on the command line: '<stack>', '<stack>:<version>', or (for input stacks)
+// '<stack>:<version>:<alias>'
+func ParseString(str string) (Stack, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) > 3 {
+		return Stack{}, canarrors.InvalidStack.Details("Versioned stack format is '<stack>:<version>[:<alias>]'.")
+	}
+	if len(parts) == 1 {
+		return Parse(str, "")
+	}
+	stack, err := Parse(parts[0], parts[1])
+	if err != nil {
+		return Stack{}, err
+	}
+	if len(parts) > 2 {
+		stack.InputAlias = parts[2]
+	}
+	return stack, nil
+}
+
 func (s Stack) String() string {
 	if s.legacy {
 		return "legacy"
@@ -57,19 +77,21 @@ func (s Stack) String() string {
 
 }
 
-func (s Stack) GeneratePlan(inputStacks []Stack, additionalArgs ...string) (plan []byte, err error) {
-	f, err := ioutil.TempFile("", "terracanary-plan")
-	f.Close()
-	defer func() {
-		os.Remove(f.Name())
-	}()
+// Formats an input stack the way it's given to -i/-I, including any alias
+func (s Stack) InputString() string {
+	if s.InputAlias == "" {
+		return s.String()
+	}
+	return s.String() + ":" + s.InputAlias
+}
 
-	additionalArgs = append(additionalArgs, "-out", f.Name())
+func (s Stack) writePlan(path string, inputStacks []Stack, additionalArgs ...string) (plan []byte, err error) {
+	additionalArgs = append(additionalArgs, "-out", path)
 	err = s.RunAction("plan", inputStacks, additionalArgs...)
 	if err != nil {
 		return
 	}
-	plan, err = ioutil.ReadFile(f.Name())
+	plan, err = ioutil.ReadFile(path)
 	return
 }
 
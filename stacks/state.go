@@ -0,0 +1,364 @@
+package stacks
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parsed contents of a stack's state file
+type State struct {
+	Version   int
+	Serial    uint64
+	Lineage   string
+	Outputs   map[string]OutputValue // Root module outputs only
+	Resources []ResourceState        // Current instances, sorted by address; deposed ones are excluded
+}
+
+type OutputValue struct {
+	Sensitive bool
+	Value     interface{}
+}
+
+// Resource modes, as terraform names them
+const (
+	ManagedMode = "managed"
+	DataMode    = "data" // Data sources
+)
+
+type ResourceState struct {
+	Address    string
+	Mode       string // ManagedMode or DataMode
+	Type       string
+	ID         string
+	Attributes map[string]string // Flattened, as in the v3 state format
+	Sensitive  []string          // Flattened paths of sensitive attributes; only recorded by the v4 format
+}
+
+// Reports whether the flattened attribute key is, or is inside, an attribute that state marks as sensitive
+func (r *ResourceState) SensitiveAttribute(key string) bool {
+	for _, path := range r.Sensitive {
+		if key == path || strings.HasPrefix(key, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the resource with the given address, or nil
+func (st *State) Resource(address string) *ResourceState {
+	for i := range st.Resources {
+		if st.Resources[i].Address == address {
+			return &st.Resources[i]
+		}
+	}
+	return nil
+}
+
+// Fetches the current state, reading the state file directly from S3 if possible, and otherwise using "terraform
+// state pull". A stack with no state file has an empty state.
+func (s Stack) State() (*State, error) {
+	st, err := s.readState()
+	if err == nil {
+		return st, nil
+	}
+	log.Printf("Can't read state for %s directly (%s); falling back to terraform.\n", s, err)
+	return s.pullState()
+}
+
+// Reads and parses the stack's state file from S3, without involving terraform
+func (s Stack) readState() (*State, error) {
+	raw, err := getObject(s.stateFileName())
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return &State{Outputs: make(map[string]OutputValue)}, nil
+	}
+	return parseState(raw)
+}
+
+// Fetches the current state using "terraform state pull"
+func (s Stack) pullState() (*State, error) {
+	out, err := s.CmdOutput("state", "pull")
+	if err != nil {
+		return nil, err
+	}
+	st, err := parseState([]byte(out))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing state for %s: %s", s, err)
+	}
+	return st, nil
+}
+
+// Returns the serial number of the stack's current state, which terraform increments whenever it changes the state
+func (s Stack) Serial() (uint64, error) {
+	st, err := s.State()
+	if err != nil {
+		return 0, err
+	}
+	return st.Serial, nil
+}
+
+// Formats an output value the way "terraform output <name>" does, if that's simple to do; strings (without
+// surrounding whitespace), numbers and bools are supported
+func (o OutputValue) String() (string, bool) {
+	switch v := o.Value.(type) {
+	case string:
+		return strings.TrimSpace(v), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// Parses what "terraform output -json <name>" prints: from terraform 0.12 on, just the value; before that, an object
+// also giving the output's type and sensitivity
+func parseOutputJSON(raw []byte) (OutputValue, error) {
+	var legacy struct {
+		Sensitive *bool
+		Type      *string
+		Value     interface{}
+	}
+	err := json.Unmarshal(raw, &legacy)
+	if err == nil && legacy.Sensitive != nil && legacy.Type != nil {
+		switch *legacy.Type {
+		case "string", "list", "map":
+			return OutputValue{Sensitive: *legacy.Sensitive, Value: legacy.Value}, nil
+		}
+	}
+	var value interface{}
+	err = json.Unmarshal(raw, &value)
+	return OutputValue{Value: value}, err
+}
+
+type stateV3 struct {
+	Version int
+	Serial  uint64
+	Lineage string
+	Modules []struct {
+		Path    []string
+		Outputs map[string]struct {
+			Sensitive bool
+			Value     interface{}
+		}
+		Resources map[string]struct {
+			Type    string
+			Primary *struct {
+				ID         string
+				Attributes map[string]string
+			}
+		}
+	}
+}
+
+func parseState(raw []byte) (*State, error) {
+	var header struct{ Version int }
+	err := json.Unmarshal(raw, &header)
+	if err != nil {
+		return nil, err
+	}
+	switch header.Version {
+	case 3:
+		return parseStateV3(raw)
+	case 4:
+		return parseStateV4(raw)
+	}
+	return nil, fmt.Errorf("Unsupported state format version %d", header.Version)
+}
+
+func parseStateV3(raw []byte) (*State, error) {
+	var v3 stateV3
+	err := json.Unmarshal(raw, &v3)
+	if err != nil {
+		return nil, err
+	}
+	st := &State{
+		Version: v3.Version,
+		Serial:  v3.Serial,
+		Lineage: v3.Lineage,
+		Outputs: make(map[string]OutputValue),
+	}
+	for _, m := range v3.Modules {
+		// Paths start with "root"; treat a missing path as the root module too
+		var prefix string
+		if len(m.Path) > 1 {
+			for _, name := range m.Path[1:] {
+				prefix += "module." + name + "."
+			}
+		} else {
+			for name, o := range m.Outputs {
+				st.Outputs[name] = OutputValue{o.Sensitive, o.Value}
+			}
+		}
+		for key, r := range m.Resources {
+			rs := ResourceState{
+				Address: prefix + v3ResourceAddress(key),
+				Mode:    ManagedMode,
+				Type:    r.Type,
+			}
+			if strings.HasPrefix(key, "data.") {
+				rs.Mode = DataMode
+			}
+			if r.Primary != nil {
+				rs.ID = r.Primary.ID
+				rs.Attributes = r.Primary.Attributes
+			}
+			st.Resources = append(st.Resources, rs)
+		}
+	}
+	st.sortResources()
+	return st, nil
+}
+
+func (st *State) sortResources() {
+	sort.Slice(st.Resources, func(i, j int) bool {
+		return st.Resources[i].Address < st.Resources[j].Address
+	})
+}
+
+var v3CountSuffix = regexp.MustCompile(`\.([0-9]+)$`)
+
+// The v3 format keys counted resources as "aws_instance.foo.0"; terraform addresses them as "aws_instance.foo[0]"
+func v3ResourceAddress(key string) string {
+	parts := strings.Split(key, ".")
+	if (parts[0] == "data" && len(parts) == 4) || (parts[0] != "data" && len(parts) == 3) {
+		return v3CountSuffix.ReplaceAllString(key, "[$1]")
+	}
+	return key
+}
+
+// The state format used by terraform 0.12 and later
+type stateV4 struct {
+	Version int
+	Serial  uint64
+	Lineage string
+	Outputs map[string]struct {
+		Sensitive bool
+		Value     interface{}
+	}
+	Resources []struct {
+		Module    string // e.g. "module.foo.module.bar"; empty for the root module
+		Mode      string // "managed" or "data"
+		Type      string
+		Name      string
+		Instances []struct {
+			IndexKey       interface{}            `json:"index_key"` // Absent, a number (count) or a string (for_each)
+			Deposed        string                 // Set on old instances awaiting destruction after create_before_destroy
+			Attributes     map[string]interface{} // Nested values
+			AttributesFlat map[string]string      `json:"attributes_flat"` // Used instead for some legacy providers
+			Sensitive      [][]struct {
+				Type  string      // "get_attr" or "index"
+				Value interface{} // An attribute name, or for an index, {"value": <key>, "type": <cty type>}
+			} `json:"sensitive_attributes"`
+		}
+	}
+}
+
+func parseStateV4(raw []byte) (*State, error) {
+	var v4 stateV4
+	err := json.Unmarshal(raw, &v4)
+	if err != nil {
+		return nil, err
+	}
+	st := &State{
+		Version: v4.Version,
+		Serial:  v4.Serial,
+		Lineage: v4.Lineage,
+		Outputs: make(map[string]OutputValue),
+	}
+	for name, o := range v4.Outputs {
+		st.Outputs[name] = OutputValue{o.Sensitive, o.Value}
+	}
+	for _, r := range v4.Resources {
+		address := r.Type + "." + r.Name
+		if r.Mode == DataMode {
+			address = "data." + address
+		}
+		if r.Module != "" {
+			address = r.Module + "." + address
+		}
+		for _, i := range r.Instances {
+			if i.Deposed != "" {
+				// Like the v3 format's deposed lists, these are left out; they share the current instance's address
+				continue
+			}
+			rs := ResourceState{
+				Address:    address + v4IndexSuffix(i.IndexKey),
+				Mode:       r.Mode,
+				Type:       r.Type,
+				Attributes: i.AttributesFlat,
+			}
+			if i.Attributes != nil {
+				rs.Attributes = make(map[string]string)
+				flattenAttribute(rs.Attributes, "", i.Attributes)
+			}
+			for _, path := range i.Sensitive {
+				var steps []string
+				for _, step := range path {
+					v := step.Value
+					if index, ok := v.(map[string]interface{}); ok {
+						v = index["value"]
+					}
+					if n, ok := v.(float64); ok {
+						v = strconv.FormatFloat(n, 'f', -1, 64)
+					}
+					steps = append(steps, fmt.Sprint(v))
+				}
+				rs.Sensitive = append(rs.Sensitive, strings.Join(steps, "."))
+			}
+			rs.ID = rs.Attributes["id"]
+			st.Resources = append(st.Resources, rs)
+		}
+	}
+	st.sortResources()
+	return st, nil
+}
+
+func v4IndexSuffix(key interface{}) string {
+	switch k := key.(type) {
+	case float64:
+		return "[" + strconv.FormatFloat(k, 'f', -1, 64) + "]"
+	case string:
+		return "[" + strconv.Quote(k) + "]"
+	}
+	return ""
+}
+
+// Flattens a nested attribute value into the v3 state format's representation, in which lists have a "<key>.#" count
+// and elements "<key>.<index>", and maps have a "<key>.%" count and elements "<key>.<name>". Null values are omitted.
+func flattenAttribute(flat map[string]string, key string, value interface{}) {
+	prefix := key
+	if prefix != "" {
+		prefix += "."
+	}
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		if key != "" {
+			flat[prefix+"%"] = strconv.Itoa(len(v))
+		}
+		for name, elem := range v {
+			flattenAttribute(flat, prefix+name, elem)
+		}
+	case []interface{}:
+		flat[prefix+"#"] = strconv.Itoa(len(v))
+		for i, elem := range v {
+			flattenAttribute(flat, prefix+strconv.Itoa(i), elem)
+		}
+	case string:
+		flat[key] = v
+	case bool:
+		flat[key] = strconv.FormatBool(v)
+	case float64:
+		flat[key] = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		flat[key] = fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,230 @@
+package stacks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestV3ResourceAddress(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"aws_instance.web", "aws_instance.web"},
+		{"aws_instance.web.0", "aws_instance.web[0]"},
+		{"aws_instance.web.12", "aws_instance.web[12]"},
+		{"data.aws_ami.ubuntu", "data.aws_ami.ubuntu"},
+		{"data.aws_ami.ubuntu.1", "data.aws_ami.ubuntu[1]"},
+	}
+	for _, tt := range tests {
+		if got := v3ResourceAddress(tt.key); got != tt.want {
+			t.Errorf("v3ResourceAddress(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParseStateV3(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		resources []ResourceState
+		outputs   map[string]OutputValue
+	}{
+		{
+			name: "root and nested modules",
+			raw: `{"version": 3, "serial": 7, "lineage": "abc", "modules": [
+				{"path": ["root"], "outputs": {"host": {"sensitive": false, "value": "example.com"}},
+				 "resources": {
+					"aws_instance.web.0": {"type": "aws_instance", "primary": {"id": "i-1", "attributes": {"id": "i-1"}}},
+					"data.aws_ami.ubuntu": {"type": "aws_ami", "primary": {"id": "ami-1"}}}},
+				{"path": ["root", "site", "cdn"], "outputs": {"ignored": {"value": "x"}},
+				 "resources": {"aws_s3_bucket.b": {"type": "aws_s3_bucket"}}}]}`,
+			resources: []ResourceState{
+				{Address: "aws_instance.web[0]", Mode: ManagedMode, Type: "aws_instance", ID: "i-1", Attributes: map[string]string{"id": "i-1"}},
+				{Address: "data.aws_ami.ubuntu", Mode: DataMode, Type: "aws_ami", ID: "ami-1"},
+				{Address: "module.site.module.cdn.aws_s3_bucket.b", Mode: ManagedMode, Type: "aws_s3_bucket"},
+			},
+			outputs: map[string]OutputValue{"host": {false, "example.com"}},
+		},
+		{
+			name: "module without a path",
+			raw: `{"version": 3, "modules": [{"outputs": {"n": {"value": 1}},
+				"resources": {"aws_eip.ip": {"type": "aws_eip", "primary": {"id": "eip-1"}}}}]}`,
+			resources: []ResourceState{
+				{Address: "aws_eip.ip", Mode: ManagedMode, Type: "aws_eip", ID: "eip-1"},
+			},
+			outputs: map[string]OutputValue{"n": {false, float64(1)}},
+		},
+		{
+			name:    "empty",
+			raw:     `{"version": 3, "modules": []}`,
+			outputs: map[string]OutputValue{},
+		},
+	}
+	for _, tt := range tests {
+		st, err := parseState([]byte(tt.raw))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(st.Resources, tt.resources) {
+			t.Errorf("%s: resources = %+v, want %+v", tt.name, st.Resources, tt.resources)
+		}
+		if !reflect.DeepEqual(st.Outputs, tt.outputs) {
+			t.Errorf("%s: outputs = %+v, want %+v", tt.name, st.Outputs, tt.outputs)
+		}
+	}
+}
+
+func TestParseStateV4(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		resources []ResourceState
+	}{
+		{
+			name: "modes, modules and index keys",
+			raw: `{"version": 4, "serial": 3, "resources": [
+				{"mode": "managed", "type": "aws_instance", "name": "web", "instances": [
+					{"index_key": 0, "attributes": {"id": "i-0", "tags": {"Name": "a"}, "ports": [80, 443], "gone": null}},
+					{"index_key": 1, "attributes": {"id": "i-1"}}]},
+				{"mode": "data", "type": "aws_ami", "name": "ubuntu", "instances": [{"attributes": {"id": "ami-1"}}]},
+				{"mode": "managed", "type": "aws_eip", "name": "ip", "instances": [
+					{"attributes": {"id": "eip-new"}}, {"deposed": "00000001", "attributes": {"id": "eip-old"}}]},
+				{"module": "module.data", "mode": "managed", "type": "aws_s3_bucket", "name": "b", "instances": [
+					{"index_key": "x.y", "attributes_flat": {"id": "bucket"}}]}]}`,
+			resources: []ResourceState{
+				{Address: "aws_eip.ip", Mode: ManagedMode, Type: "aws_eip", ID: "eip-new", Attributes: map[string]string{"id": "eip-new"}},
+				{Address: "aws_instance.web[0]", Mode: ManagedMode, Type: "aws_instance", ID: "i-0", Attributes: map[string]string{
+					"id": "i-0", "tags.%": "1", "tags.Name": "a", "ports.#": "2", "ports.0": "80", "ports.1": "443",
+				}},
+				{Address: "aws_instance.web[1]", Mode: ManagedMode, Type: "aws_instance", ID: "i-1", Attributes: map[string]string{"id": "i-1"}},
+				{Address: "data.aws_ami.ubuntu", Mode: DataMode, Type: "aws_ami", ID: "ami-1", Attributes: map[string]string{"id": "ami-1"}},
+				{Address: `module.data.aws_s3_bucket.b["x.y"]`, Mode: ManagedMode, Type: "aws_s3_bucket", ID: "bucket", Attributes: map[string]string{"id": "bucket"}},
+			},
+		},
+		{
+			name: "sensitive attributes",
+			raw: `{"version": 4, "resources": [
+				{"mode": "managed", "type": "aws_db_instance", "name": "db", "instances": [
+					{"attributes": {"id": "db-1", "password": "hunter2", "tags": {"token": "t"}, "ports": [1, 2]},
+					 "sensitive_attributes": [
+						[{"type": "get_attr", "value": "password"}],
+						[{"type": "get_attr", "value": "tags"}, {"type": "index", "value": {"value": "token", "type": "string"}}],
+						[{"type": "get_attr", "value": "ports"}, {"type": "index", "value": {"value": 1, "type": "number"}}]]}]}]}`,
+			resources: []ResourceState{
+				{Address: "aws_db_instance.db", Mode: ManagedMode, Type: "aws_db_instance", ID: "db-1", Attributes: map[string]string{
+					"id": "db-1", "password": "hunter2", "tags.%": "1", "tags.token": "t", "ports.#": "2", "ports.0": "1", "ports.1": "2",
+				}, Sensitive: []string{"password", "tags.token", "ports.1"}},
+			},
+		},
+		{
+			name: "empty",
+			raw:  `{"version": 4, "resources": []}`,
+		},
+	}
+	for _, tt := range tests {
+		st, err := parseState([]byte(tt.raw))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(st.Resources, tt.resources) {
+			t.Errorf("%s: resources = %+v, want %+v", tt.name, st.Resources, tt.resources)
+		}
+	}
+}
+
+func TestParseStateVersions(t *testing.T) {
+	for _, raw := range []string{`{"version": 2}`, `{"version": 5}`, `not json`} {
+		if _, err := parseState([]byte(raw)); err == nil {
+			t.Errorf("parseState(%q) succeeded; want an error", raw)
+		}
+	}
+}
+
+func TestSensitiveAttribute(t *testing.T) {
+	r := ResourceState{Sensitive: []string{"password", "tags.token"}}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"password", true},
+		{"password_length", false},
+		{"tags.token", true},
+		{"tags.token.inner", true},
+		{"tags.%", false},
+		{"id", false},
+	}
+	for _, tt := range tests {
+		if got := r.SensitiveAttribute(tt.key); got != tt.want {
+			t.Errorf("SensitiveAttribute(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestOutputValueString(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+		ok    bool
+	}{
+		{" host.example.com\n", "host.example.com", true},
+		{true, "true", true},
+		{float64(8080), "8080", true},
+		{1.5, "1.5", true},
+		// Left to terraform
+		{[]interface{}{"a", float64(1)}, "", false},
+		{map[string]interface{}{"b": "2", "a": true}, "", false},
+		{nil, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := OutputValue{Value: tt.value}.String()
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("OutputValue{%#v}.String() = %q, %v; want %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// Outputs read directly from state and from "terraform output -json" (in either format) must print the same, or both
+// be left to "terraform output <name>"
+func TestOutputPathsAgree(t *testing.T) {
+	state := []byte(`{
+		"version": 4,
+		"outputs": {
+			"padded": {"value": "  host.example.com\n", "type": "string"},
+			"port": {"value": 8080, "type": "number"},
+			"list": {"value": ["a", "b"], "type": ["list", "string"]},
+			"map": {"value": {"b": "2", "a": "1"}, "type": ["map", "string"]}
+		},
+		"resources": []
+	}`)
+	terraform := map[string][]string{
+		"padded": {`"  host.example.com\n"`, `{"sensitive": false, "type": "string", "value": "  host.example.com\n"}`},
+		"port":   {`8080`},
+		"list":   {`["a", "b"]`, `{"sensitive": false, "type": "list", "value": ["a", "b"]}`},
+		"map":    {`{"b": "2", "a": "1"}`, `{"sensitive": false, "type": "map", "value": {"a": "1", "b": "2"}}`},
+	}
+	st, err := parseState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, outputs := range terraform {
+		if _, found := st.Outputs[name]; !found {
+			t.Errorf("%s: no value in state", name)
+			continue
+		}
+		direct, directOK := st.Outputs[name].String()
+		for _, raw := range outputs {
+			value, err := parseOutputJSON([]byte(raw))
+			if err != nil {
+				t.Errorf("%s: error parsing %s: %s", name, raw, err)
+				continue
+			}
+			if fallback, ok := value.String(); fallback != direct || ok != directOK {
+				t.Errorf("%s: state gives %q, %v, but terraform output -json %s gives %q, %v",
+					name, direct, directOK, raw, fallback, ok)
+			}
+		}
+	}
+}
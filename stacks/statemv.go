@@ -0,0 +1,282 @@
+package stacks
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+	"github.com/myhelix/terracanary/config"
+
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A resource (or module) address to move from one state to another, and the address to give it in the destination
+type ResourceMove struct {
+	From string
+	To   string // Same as From if empty
+}
+
+func (m ResourceMove) destination() string {
+	if m.To == "" {
+		return m.From
+	}
+	return m.To
+}
+
+// True if address is, or is within, the resource or module at the given address: "module.foo" covers everything in
+// that module, and "aws_instance.foo" covers its counted instances.
+func addressCovers(covering, address string) bool {
+	return address == covering || strings.HasPrefix(address, covering+".") || strings.HasPrefix(address, covering+"[")
+}
+
+// Takes the lock on the stack's directory (see workDir), for operations that don't otherwise run terraform there.
+// Isolated processes don't lock directories, and the legacy stack doesn't have one.
+func (s Stack) lock() error {
+	if IsolatedWorkdirs || s.legacy || s.WorkingDirectory != "" {
+		return nil
+	}
+	_, err := s.workDir()
+	return err
+}
+
+// Creates a temporary directory whose only configuration is the S3 backend, for pulling and pushing the states of
+// stacks without needing their terraform configuration (or any providers). Returns the directory and a function
+// that removes it.
+func backendOnlyDir() (string, func(), error) {
+	dir, err := ioutil.TempDir("", "terracanary-backend")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "backend.tf"), []byte("terraform {\n  backend \"s3\" {}\n}\n"), 0644)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// Runs "terraform state <args>" against the stack's remote state from the backend-only directory, returning stdout
+func (s Stack) backendStateCmd(dir string, args ...string) (string, error) {
+	s.WorkingDirectory = dir
+	buf := bytes.Buffer{}
+	writer := bufio.NewWriter(&buf)
+	cmd := Command{
+		Stack:  s,
+		Init:   true,
+		Stdout: writer,
+		Action: "state",
+		Args:   args,
+	}
+	err := cmd.Run()
+	writer.Flush()
+	return buf.String(), err
+}
+
+// State backups are kept in the state file bucket, outside the state file base (so that they aren't listed with the
+// stacks). They're never removed by terracanary; an S3 lifecycle rule on this prefix can expire them.
+func BackupPrefix() string {
+	return "terracanary-backups/" + config.Global.StateFileBase + "/"
+}
+
+// Saves the raw state under BackupPrefix, returning the key it was saved under; suffix distinguishes backups of
+// states that were never pushed from those of the original states
+func (s Stack) backupState(raw []byte, suffix string) (string, error) {
+	key := fmt.Sprintf("%s%s/%s%s.tfstate", BackupPrefix(), s, time.Now().UTC().Format("20060102T150405Z"), suffix)
+	err := putObject(key, raw)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Backed up state of %s to s3://%s/%s\n", s, config.Global.StateFileBucket, key)
+	return key, nil
+}
+
+// Fails if the stack's remote state no longer has the serial it had when we pulled it (0 meaning no state)
+func (s Stack) checkSerial(expected uint64) error {
+	current, err := s.readState()
+	if err != nil {
+		return err
+	}
+	if current.Serial != expected {
+		return canarrors.StateChanged.Details(s, " serial is now ", current.Serial, "; expected ", expected)
+	}
+	return nil
+}
+
+// Moves resources from one stack's state to another's, as "terraform state mv" does within a single state. Both
+// states are pulled and backed up in the state file bucket, the moves are made on local copies, and the results
+// are pushed (destination first, so that a failure part way through can't lose track of the resources) and
+// verified. The destination stack doesn't have to exist yet. Both stacks' directories are locked throughout, and
+// nothing is pushed if either state has been changed since it was pulled.
+func MoveResources(from, to Stack, moves []ResourceMove) error {
+	if from.stateFileName() == to.stateFileName() {
+		return canarrors.InvalidStack.Details("Can't move resources from ", from, " to itself; use terraform state mv")
+	}
+	if len(moves) == 0 {
+		return nil
+	}
+	for _, s := range []Stack{from, to} {
+		err := s.lock()
+		if err != nil {
+			return err
+		}
+	}
+
+	backendDir, cleanup, err := backendOnlyDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	localDir, err := ioutil.TempDir("", "terracanary-state")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(localDir)
+
+	files := map[Stack]string{
+		from: filepath.Join(localDir, "from.tfstate"),
+		to:   filepath.Join(localDir, "to.tfstate"),
+	}
+	pulledSerials := make(map[Stack]uint64)
+	backups := make(map[Stack]string)
+	for _, s := range []Stack{from, to} {
+		raw, err := s.backendStateCmd(backendDir, "pull")
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(raw) == "" {
+			if s == from {
+				return canarrors.NoSuchStack.Details(s)
+			}
+			// Created by the move
+			continue
+		}
+		st, err := parseState([]byte(raw))
+		if err != nil {
+			return fmt.Errorf("Error parsing state for %s: %s", s, err)
+		}
+		pulledSerials[s] = st.Serial
+		backups[s], err = s.backupState([]byte(raw), "")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(files[s], []byte(raw), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, m := range moves {
+		log.Printf("Moving %s in %s to %s in %s\n", m.From, from, m.destination(), to)
+		cmd := Command{
+			Stack:  from,
+			Action: "state",
+			Args:   []string{"mv", "-state=" + files[from], "-state-out=" + files[to], m.From, m.destination()},
+		}
+		cmd.WorkingDirectory = localDir
+		err = cmd.Run()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range []Stack{from, to} {
+		err = s.checkSerial(pulledSerials[s])
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Pushing new state of %s\n", to)
+	_, err = to.backendStateCmd(backendDir, "push", files[to])
+	if err != nil {
+		return err
+	}
+	log.Printf("Pushing new state of %s\n", from)
+	_, err = from.backendStateCmd(backendDir, "push", files[from])
+	if err != nil {
+		logPartialMove(from, to, files[from], backups)
+		return canarrors.StateChanged.Details("new state of ", to, " was pushed, but pushing ", from, " failed (", err,
+			"); see above for how to recover")
+	}
+
+	return verifyMove(from, to, files, moves)
+}
+
+// After the destination's new state has been pushed but the source's hasn't, the moved resources are in both states.
+// Saves the source's unpushed state alongside the backups, and logs how to push it to finish the move.
+func logPartialMove(from, to Stack, fromFile string, backups map[Stack]string) {
+	bucket := config.Global.StateFileBucket
+	log.Printf("The moved resources are now in the states of both %s and %s.\n", to, from)
+	for _, s := range []Stack{from, to} {
+		if backups[s] != "" {
+			log.Printf("The state of %s before the move is backed up at s3://%s/%s\n", s, bucket, backups[s])
+		}
+	}
+	raw, err := ioutil.ReadFile(fromFile)
+	if err == nil {
+		var key string
+		key, err = from.backupState(raw, "-unpushed")
+		if err == nil {
+			log.Printf(`To finish the move, push the new state of %s from an empty directory:
+	printf 'terraform {\n  backend "s3" {}\n}\n' > backend.tf
+	terraform init -backend-config=region=%s -backend-config=bucket=%s -backend-config=key=%s
+	aws s3 cp s3://%s/%s new.tfstate
+	terraform state push new.tfstate
+`, from, config.Global.AWSRegion, bucket, from.stateFileName(), bucket, key)
+			return
+		}
+	}
+	log.Printf("Couldn't save the new state of %s (%s); to undo the move, push the backup of %s's state with "+
+		"\"terraform state push -force\" from a directory initialized with its backend.\n", from, err, to)
+}
+
+// Checks that the pushed states are the ones we wrote, and that the moved resources ended up in the right place
+func verifyMove(from, to Stack, files map[Stack]string, moves []ResourceMove) error {
+	for _, s := range []Stack{from, to} {
+		raw, err := ioutil.ReadFile(files[s])
+		if err != nil {
+			return err
+		}
+		written, err := parseState(raw)
+		if err != nil {
+			return err
+		}
+		err = s.checkSerial(written.Serial)
+		if err != nil {
+			return err
+		}
+	}
+
+	fromState, err := from.readState()
+	if err != nil {
+		return err
+	}
+	toState, err := to.readState()
+	if err != nil {
+		return err
+	}
+	for _, m := range moves {
+		for _, r := range fromState.Resources {
+			if addressCovers(m.From, r.Address) {
+				return canarrors.StateChanged.Details(r.Address, " is still in ", from, " after moving it")
+			}
+		}
+		found := false
+		for _, r := range toState.Resources {
+			found = found || addressCovers(m.destination(), r.Address)
+		}
+		if !found {
+			return canarrors.StateChanged.Details(m.destination(), " is missing from ", to, " after moving it")
+		}
+	}
+	log.Printf("Moved %d address(es) from %s (now serial %d) to %s (now serial %d).\n",
+		len(moves), from, fromState.Serial, to, toState.Serial)
+	return nil
+}
@@ -12,16 +12,22 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
-var runningCmd *terraformCmd
+// Processes that have been started and not yet waited for; the signal handler waits for (or kills) them before
+// exiting
+var running = make(map[*runningProcess]bool)
 var cmdMutex sync.Mutex
 
+type runningProcess struct {
+	*exec.Cmd
+	done chan struct{} // Closed once the process has exited
+}
+
 type Command struct {
 	Stack
 	Args             []string  // args for command
@@ -45,32 +51,45 @@ func init() {
 	//os.Setenv("TF_LOG", "TRACE")
 }
 
-// Keep track of what's running, so that the signal handler goroutine can kill it if necessary
 func (c *terraformCmd) Run() (err error) {
 	log.Println("Running in", c.Dir+":")
 	log.Println(strings.Join(c.Args, " "))
 
-	// Lock mutex while process is starting up to avoid signal handler race condition
-	cmdMutex.Lock()
-	runningCmd = c
-	err = c.Cmd.Start()
-	cmdMutex.Unlock()
-
-	// If process started up, wait for it, with mutex unlocked to allow signal handling
-	if err == nil {
-		err = c.Cmd.Wait()
-	}
+	err = RunProcess(c.Cmd)
 
 	if err == nil {
 		log.Println("Terraform exited success.")
 	} else {
 		log.Println("Terraform exited failure.")
 	}
+	return
+}
 
-	// Locked mutex here both to synchronously unset runningCmd, but more importantly to ensure that if signal handling
-	// is in process, our caller can't start a new command before signal handling completes and os.Exit is called.
+// Runs a process (terraform, or a terracanary subprocess), keeping track of it so that the signal handler can wait
+// for it to exit, or kill it if necessary.
+func RunProcess(cmd *exec.Cmd) (err error) {
+	p := &runningProcess{cmd, make(chan struct{})}
+
+	// Lock mutex while process is starting up to avoid signal handler race condition
 	cmdMutex.Lock()
-	runningCmd = nil
+	err = cmd.Start()
+	if err == nil {
+		running[p] = true
+	}
+	cmdMutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	// Wait with mutex unlocked to allow signal handling
+	err = cmd.Wait()
+	close(p.done)
+
+	// Locked mutex here both to synchronously remove the process, but more importantly to ensure that if signal
+	// handling is in process, our caller can't start a new command before signal handling completes and os.Exit is
+	// called.
+	cmdMutex.Lock()
+	delete(running, p)
 	cmdMutex.Unlock()
 	return
 }
@@ -83,22 +102,27 @@ func handleSignals() {
 	go func() {
 		sig := <-c
 		cmdMutex.Lock() // We'll hold this until we exit to prevent new commands from starting
-		if runningCmd != nil {
-			// terraform will receive the signal directly; the shell or init process will signal our entire process group
+		if len(running) > 0 {
+			// Processes will receive the signal directly; the shell or init process will signal our entire process
+			// group
 			log.Println("Received first signal; waiting to see if terraform exits cleanly. Signal again to kill.")
-			p := make(chan bool, 1)
+			allDone := make(chan bool, 1)
 			go func() {
-				runningCmd.Process.Wait()
-				p <- true
+				for p := range running {
+					<-p.done
+				}
+				allDone <- true
 			}()
 			select {
-			case <-p:
-				// Terraform exited on its own; fall through and exit.
+			case <-allDone:
+				// Everything exited on its own; fall through and exit.
 			case sig := <-c:
 				log.Println("Received 2nd signal; killing terraform.")
 				// Give it a moment to process the 2nd signal itself before killing it outright
 				time.Sleep(time.Millisecond * 500)
-				runningCmd.Process.Kill()
+				for p := range running {
+					p.Process.Kill()
+				}
 				canarrors.Killed.Details(sig).Exit()
 			}
 		}
@@ -106,44 +130,43 @@ func handleSignals() {
 	}()
 }
 
-func (s Stack) RemoveFromState(names []string) error {
-	if len(names) > 0 {
-		nMap := make(map[string]bool)
-		for _, l := range names {
-			nMap[l] = true
-		}
-
-		resources, err := s.StateList()
-		if err != nil {
-			return err
-		}
-		var remove, leave []string
-		for _, r := range resources {
-			if nMap[r] {
-				remove = append(remove, r)
-			} else {
-				leave = append(leave, r)
-			}
-		}
-		log.Println("Removing from state:", remove)
-		log.Println("Left in state:", leave)
-		cmd := Command{
-			Stack:  s,
-			Action: "state",
+// Removes resources matching any of the patterns (see MatchAddress) from the stack's state, so that terraform forgets
+// about them instead of destroying them. Returns the resources removed, as they were in the state.
+func (s Stack) RemoveFromState(patterns []string) (removed []ResourceState, err error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	st, err := s.State()
+	if err != nil {
+		return nil, err
+	}
+	var remove, leave []string
+	for _, r := range st.Resources {
+		if MatchAnyAddress(patterns, r.Address) {
+			remove = append(remove, r.Address)
+			removed = append(removed, r)
+		} else {
+			leave = append(leave, r.Address)
 		}
-		err = cmd.InitTerraform()
+	}
+	log.Println("Removing from state:", remove)
+	log.Println("Left in state:", leave)
+	cmd := Command{
+		Stack:  s,
+		Action: "state",
+	}
+	err = cmd.InitTerraform()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range remove {
+		cmd.Args = []string{"rm", r}
+		err = cmd.Run()
 		if err != nil {
-			return err
-		}
-		for _, r := range remove {
-			cmd.Args = []string{"rm", r}
-			err = cmd.Run()
-			if err != nil {
-				return err
-			}
+			return nil, err
 		}
 	}
-	return nil
+	return removed, nil
 }
 
 // Run destroy; no confirmation
@@ -174,10 +197,28 @@ func (s Stack) Destroy(inputStacks []Stack, additionalArgs ...string) error {
 	if err != nil {
 		return err
 	}
+	err = s.RemoveMetadata()
+	if err != nil {
+		return err
+	}
+	err = RemoveRecord(s.configRecord())
+	if err != nil {
+		return err
+	}
 	log.Println("Stack destroyed:", s)
 	return nil
 }
 
+// Run apply, and record the inputs and outcome in the stack's metadata
+func (s Stack) Apply(inputStacks []Stack, additionalArgs ...string) error {
+	err := s.RunAction("apply", inputStacks, additionalArgs...)
+	recordErr := s.recordApply(inputStacks, additionalArgs, err == nil)
+	if err != nil {
+		return err
+	}
+	return recordErr
+}
+
 func (s Stack) RunAction(action string, inputStacks []Stack, additionalArgs ...string) error {
 	cmd, err := s.ActionCommand(action, inputStacks, additionalArgs...)
 	if err != nil {
@@ -232,7 +273,22 @@ func (s Stack) ActionCommand(action string, inputStacks []Stack, additionalArgs
 	}, nil
 }
 
+// Lists the addresses of all resources in the stack's state, reading the state file directly if possible (and for the
+// legacy stack, only that way)
 func (s Stack) StateList() (state []string, err error) {
+	st, err := s.readState()
+	if err == nil {
+		for _, r := range st.Resources {
+			state = append(state, r.Address)
+		}
+		return
+	}
+	if s.legacy {
+		// The legacy stack has no subdir to run terraform in
+		return nil, err
+	}
+	log.Printf("Can't read state for %s directly (%s); falling back to terraform.\n", s, err)
+
 	out, err := s.CmdOutput("state", "list")
 	if err != nil {
 		return
@@ -249,15 +305,41 @@ func (s Stack) StateList() (state []string, err error) {
 
 // This gets a single terraform output variable
 func (s Stack) Output(name string) (string, error) {
-	return s.CmdOutput("output", name)
+	out, err := s.Outputs(name)
+	if err != nil {
+		return "", err
+	}
+	return out[0], nil
 }
 
-// Get multiple terraform output variables, in the order specified
+// Get multiple terraform output variables, in the order specified. Strings, numbers and bools are read directly from
+// the state file if possible, or otherwise from "terraform output -json", and formatted by OutputValue.String either
+// way; lists and maps are left to "terraform output <name>", so that they're formatted as terraform does.
 func (s Stack) Outputs(names ...string) (out []string, err error) {
+	st, err := s.readState()
+	if err != nil {
+		log.Printf("Can't read state for %s directly (%s); falling back to terraform.\n", s, err)
+		st = &State{}
+	}
 	for _, name := range names {
-		o, err := s.Output(name)
-		if err != nil {
-			return nil, err
+		value, found := st.Outputs[name]
+		if !found {
+			// Including missing outputs, so that terraform reports the error
+			jsn, err := s.CmdOutput("output", "-json", name)
+			if err != nil {
+				return nil, err
+			}
+			value, err = parseOutputJSON([]byte(jsn))
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing output %s of %s: %s", name, s, err)
+			}
+		}
+		o, ok := value.String()
+		if !ok {
+			o, err = s.CmdOutput("output", name)
+			if err != nil {
+				return nil, err
+			}
 		}
 		out = append(out, o)
 	}
@@ -278,32 +360,31 @@ func (s Stack) CmdOutput(action string, args ...string) (string, error) {
 	return strings.TrimSpace(buf.String()), err
 }
 
-type initState struct {
-	Done    bool
-	Version uint
-}
+func (c Command) InitTerraform() error {
+	dir, err := c.workDir()
+	if err != nil {
+		return err
+	}
 
-var initStates = make(map[string]initState)
+	args := append(
+		append([]string{}, config.Global.InitArgs...),
+		"-backend-config=region="+config.Global.AWSRegion,
+		"-backend-config=bucket="+config.Global.StateFileBucket,
+		"-backend-config=key="+c.stateFileName(),
+	)
 
-func (c Command) InitTerraform() error {
-	// Skip cache if working directory is overridden
-	if c.WorkingDirectory == "" {
-		if initStates[c.Subdir].Done && initStates[c.Subdir].Version == c.Version {
-			log.Printf("Already initialized %s to version %d.\n", c.Subdir, c.Version)
-			return nil
-		}
+	// Skip cache if working directory is overridden. The record of the last init is kept in the directory, so this
+	// also lets separate terracanary invocations (e.g. a series of "terracanary output" calls) share an init.
+	if c.WorkingDirectory == "" && initUpToDate(dir, c.stateFileName(), args) {
+		log.Printf("Already initialized %s to version %d.\n", c.Subdir, c.Version)
+		return nil
 	}
 
 	// Clear any existing local state; otherwise terraform will want to know if we should re-use it if there's no
 	// existing remote state
-	var oldstate string
-	if c.WorkingDirectory == "" {
-		oldstate = c.Subdir + "/.terraform/terraform.tfstate"
-	} else {
-		oldstate = c.WorkingDirectory + "/.terraform/terraform.tfstate"
-	}
+	oldstate := dir + "/.terraform/terraform.tfstate"
 
-	err := os.Remove(oldstate)
+	err = os.Remove(oldstate)
 	if err != nil {
 		if !strings.Contains(err.Error(), "no such file") {
 			return err
@@ -313,13 +394,6 @@ func (c Command) InitTerraform() error {
 		//log.Println("Removed old state at: " + oldstate)
 	}
 
-	args := append(
-		config.Global.InitArgs,
-		"-backend-config=region="+config.Global.AWSRegion,
-		"-backend-config=bucket="+config.Global.StateFileBucket,
-		"-backend-config=key="+c.stateFileName(),
-	)
-
 	// Output isn't helpful unless there's some sort of failure
 	buf := bytes.Buffer{}
 	writer := bufio.NewWriter(&buf)
@@ -343,10 +417,7 @@ func (c Command) InitTerraform() error {
 
 	// Skip cache if working directory is overridden
 	if c.WorkingDirectory == "" {
-		initStates[c.Subdir] = initState{
-			Done:    true,
-			Version: c.Version,
-		}
+		return recordInit(dir, c.stateFileName(), args)
 	}
 	return nil
 }
@@ -383,20 +454,11 @@ func (c Command) Run() error {
 
 	cmd := exec.Command("terraform", args...)
 
-	if c.WorkingDirectory == "" {
-		// Normal case; based on Subdir
-		if c.Subdir == "" {
-			canarrors.InvalidStack.Details("Tried to run command for stack with no subdir.").Exit()
-		}
-		wd, err := os.Getwd()
-		if err != nil {
-			return err
-		}
-		cmd.Dir = filepath.Join(wd, c.Subdir)
-	} else {
-		// Weird case; override working directory
-		cmd.Dir = c.WorkingDirectory
+	dir, err := c.workDir()
+	if err != nil {
+		return err
 	}
+	cmd.Dir = dir
 
 	// By default, send all output to stderr to avoid polluting output of terracanary commands with output data
 	if c.Stdout == nil {
@@ -413,7 +475,7 @@ func (c Command) Run() error {
 		cmd.Stdin = os.Stdin
 	}
 
-	err := (&terraformCmd{cmd}).Run()
+	err = (&terraformCmd{cmd}).Run()
 
 	if c.OutputSeparators {
 		fmt.Fprintln(os.Stderr, "\n======================================================================\n")
@@ -0,0 +1,48 @@
+package stacks
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+type TerraformVersion struct {
+	Major, Minor, Patch int
+}
+
+func (v TerraformVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v TerraformVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+var detectedVersion TerraformVersion
+var detectVersionErr error
+var detectVersionOnce sync.Once
+
+var versionPattern = regexp.MustCompile(`Terraform v([0-9]+)\.([0-9]+)\.([0-9]+)`)
+
+// Returns the version of the terraform binary on the path; only checked once per run
+func InstalledTerraformVersion() (TerraformVersion, error) {
+	detectVersionOnce.Do(func() {
+		out, err := exec.Command("terraform", "version").Output()
+		if err != nil {
+			detectVersionErr = fmt.Errorf("Error running 'terraform version': %s", err)
+			return
+		}
+		groups := versionPattern.FindStringSubmatch(string(out))
+		if groups == nil {
+			detectVersionErr = fmt.Errorf("Couldn't find version in 'terraform version' output: %s", out)
+			return
+		}
+		// Pattern guarantees these parse
+		detectedVersion.Major, _ = strconv.Atoi(groups[1])
+		detectedVersion.Minor, _ = strconv.Atoi(groups[2])
+		detectedVersion.Patch, _ = strconv.Atoi(groups[3])
+	})
+	return detectedVersion, detectVersionErr
+}
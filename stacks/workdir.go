@@ -0,0 +1,259 @@
+package stacks
+
+import (
+	"github.com/myhelix/terracanary/canarrors"
+
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When set, each stack that terraform runs for gets a private overlay of the project for the lifetime of this
+// process (see Overlay), so that other terracanary processes running in the same checkout can't interfere with its
+// backend configuration. Otherwise, terraform runs directly in the stack's subdirectory, which is locked against use by
+// other terracanary processes until this one exits.
+var IsolatedWorkdirs bool
+
+// How long to wait for another terracanary process to release a stack subdirectory before giving up. Processes each
+// holding a subdirectory the other is waiting for would otherwise wait forever.
+var LockTimeout = 10 * time.Minute
+
+var workdirs = make(map[string]string) // State file name => working directory, for isolated stacks
+var subdirLocks = make(map[string]*subdirLock)
+var workdirMutex sync.Mutex // Guards workdirs and subdirLocks; never held while waiting for another process
+
+// Whether this process holds the lock on a stack subdirectory; its mutex is held while taking the lock, so that
+// goroutines needing the same subdirectory wait for each other without blocking the rest
+type subdirLock struct {
+	sync.Mutex
+	held bool
+}
+
+// Returns the directory to run terraform in for the stack, creating an overlay or taking the subdirectory lock as
+// needed.
+func (s Stack) workDir() (string, error) {
+	if s.WorkingDirectory != "" {
+		return s.WorkingDirectory, nil
+	}
+	if s.Subdir == "" {
+		return "", canarrors.InvalidStack.Details("Tried to run command for stack with no subdir.")
+	}
+
+	if !IsolatedWorkdirs {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		dir := filepath.Join(wd, s.Subdir)
+		return dir, lockSubdir(s.Subdir, filepath.Join(dir, ".terraform"))
+	}
+
+	workdirMutex.Lock()
+	defer workdirMutex.Unlock()
+
+	key := s.stateFileName()
+	if dir, ok := workdirs[key]; ok {
+		return dir, nil
+	}
+	err := usePluginCache()
+	if err != nil {
+		return "", err
+	}
+	root, cleanup, err := Overlay(s.Subdir)
+	if err != nil {
+		return "", err
+	}
+	canarrors.AtExit(cleanup)
+	workdirs[key] = filepath.Join(root, s.Subdir)
+	log.Printf("Using private copy of %s for %s: %s\n", s.Subdir, s, workdirs[key])
+	return workdirs[key], nil
+}
+
+// Locks held by this process and its terracanary ancestors, passed on to subprocesses (e.g. checks and pipeline shell
+// steps that run terracanary themselves) so that they don't wait for locks their parent holds
+const heldLocksEnv = "TERRACANARY_HELD_LOCKS"
+
+// Takes the lock on the stack subdirectory, whose terraform files are in dir, unless this process already holds it
+func lockSubdir(subdir, dir string) error {
+	workdirMutex.Lock()
+	l, ok := subdirLocks[subdir]
+	if !ok {
+		l = &subdirLock{}
+		subdirLocks[subdir] = l
+	}
+	workdirMutex.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+	if l.held {
+		return nil
+	}
+	err := lockDir(dir, LockTimeout)
+	if err != nil {
+		return err
+	}
+	l.held = true
+	return nil
+}
+
+// How often to retry a lock held by another process
+const lockPollInterval = time.Second
+
+// Holds an exclusive advisory lock on a file in the directory (created if need be) until this process exits, waiting
+// up to the timeout for any other terracanary process holding it
+func lockDir(dir string, timeout time.Duration) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "terracanary.lock")
+	held := filepath.SplitList(os.Getenv(heldLocksEnv))
+	for _, h := range held {
+		if h == path {
+			// Our parent holds it, and is waiting for us
+			return nil
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Deliberately never closed once locked; the lock is released when the process exits
+	locked, err := tryLock(f)
+	if err != nil {
+		return fmt.Errorf("Error locking %s: %s", path, err)
+	}
+	if !locked {
+		log.Printf("Waiting up to %s for another terracanary process using %s to finish (see --isolated)...\n",
+			timeout, filepath.Dir(dir))
+		deadline := time.Now().Add(timeout)
+		for !locked {
+			if time.Now().After(deadline) {
+				f.Close()
+				return canarrors.Timeout.Details("another terracanary process is still using ", filepath.Dir(dir),
+					" after ", timeout, "; if it's waiting for a directory this process holds, neither can finish. "+
+						"Use --isolated to avoid waiting, or --lock-timeout to wait longer.")
+			}
+			time.Sleep(lockPollInterval)
+			locked, err = tryLock(f)
+			if err != nil {
+				return fmt.Errorf("Error locking %s: %s", path, err)
+			}
+		}
+	}
+	return os.Setenv(heldLocksEnv, strings.Join(append(held, path), string(filepath.ListSeparator)))
+}
+
+var pluginCacheOnce sync.Once
+var pluginCacheErr error
+
+// Isolated working directories start without any providers; share downloaded providers between them using
+// terraform's plugin cache, unless one is already configured.
+func usePluginCache() error {
+	pluginCacheOnce.Do(func() {
+		if os.Getenv("TF_PLUGIN_CACHE_DIR") != "" {
+			return
+		}
+		home := os.Getenv("HOME")
+		if home == "" {
+			pluginCacheErr = fmt.Errorf("Can't find plugin cache directory; set HOME or TF_PLUGIN_CACHE_DIR")
+			return
+		}
+		dir := filepath.Join(home, ".terraform.d", "plugin-cache")
+		pluginCacheErr = os.MkdirAll(dir, 0755)
+		if pluginCacheErr == nil {
+			os.Setenv("TF_PLUGIN_CACHE_DIR", dir)
+		}
+	})
+	return pluginCacheErr
+}
+
+// Creates a temporary copy of the project (the current directory) for running terraform isolated from other
+// invocations. The given stack subdirectory is copied, without its .terraform directory; everything else in the
+// project is symlinked, so that relative paths (e.g. to shared modules) still work. Returns the root of the copy, and a
+// function that removes it.
+func Overlay(subdir string) (string, func(), error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", nil, err
+	}
+	root, err := ioutil.TempDir("", "terracanary-overlay")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(root)
+	}
+
+	entries, err := ioutil.ReadDir(wd)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for _, e := range entries {
+		if e.Name() == subdir && e.IsDir() {
+			err = copyDir(filepath.Join(wd, subdir), filepath.Join(root, subdir))
+		} else {
+			err = os.Symlink(filepath.Join(wd, e.Name()), filepath.Join(root, e.Name()))
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	return root, cleanup, nil
+}
+
+// Copies a directory tree, preserving symlinks and file modes, but skipping any .terraform directories (which hold
+// per-invocation backend state)
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir() && info.Name() == ".terraform":
+			return filepath.SkipDir
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode())
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}